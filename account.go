@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/refactored-spoon-backend/internal/lib"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	passwordResetPurpose     = "passwordReset"
+	emailVerificationPurpose = "emailVerification"
+
+	passwordResetTTL     = 1 * time.Hour
+	emailVerificationTTL = 48 * time.Hour
+)
+
+var (
+	// appURL is the frontend that links in emails point to
+	appURL = os.Getenv("APP_URL")
+
+	errAccountTokenInvalid = errors.New("token is invalid, expired or has already been used")
+)
+
+// accountToken is a single-use token emailed to a user, only a hash of the token is stored
+type accountToken struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	Hash      string             `bson:"hash"`
+	UserID    primitive.ObjectID `bson:"userId"`
+	Purpose   string             `bson:"purpose"`
+	ExpiresAt time.Time          `bson:"expiresAt"`
+	Used      bool               `bson:"used"`
+}
+
+// forgotPasswordRequest is the body for POST /password/forgot
+// like for login, legacy accounts are identified by a username that need not be an email
+type forgotPasswordRequest struct {
+	Email string `json:"email,omitempty" validate:"required"`
+}
+
+// resetPasswordRequest is the body for POST /password/reset
+type resetPasswordRequest struct {
+	Token    string `json:"token,omitempty" validate:"required"`
+	Password string `json:"password,omitempty" validate:"required,min=8,maxbytes=72"`
+}
+
+// verifyEmailRequest is the body for POST /email/verify
+type verifyEmailRequest struct {
+	Token string `json:"token,omitempty" validate:"required"`
+}
+
+// ForgotPassword emails a password reset link to the user with the given email
+// the lookup and the email happen in the background after responding, so that neither the response nor its timing
+// reveals whether the email belongs to a user
+func (s *server) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var forgotReq forgotPasswordRequest
+	err := decoder.Decode(&forgotReq)
+	if err != nil {
+		lib.WriteDecodeError(w, r, "could not decode forgot password request", err)
+		return
+	}
+
+	err = lib.Validate(forgotReq)
+	if err != nil {
+		lib.WriteValidationError(w, r, err)
+		return
+	}
+
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		s.sendPasswordResetEmail(forgotReq.Email)
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// sendPasswordResetEmail emails a password reset link to the user with the given email if there is one
+func (s *server) sendPasswordResetEmail(email string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := s.users.FindUserByEmail(ctx, email)
+	if err == errUserNotFound {
+		return
+	}
+	if err != nil {
+		log.Println("error looking up user for password reset: " + err.Error())
+		return
+	}
+
+	token, err := createAccountToken(ctx, s.users, user.ID, passwordResetPurpose, passwordResetTTL)
+	if err != nil {
+		log.Println("unable to create password reset token for user " + user.ID.Hex() + ": " + err.Error())
+		return
+	}
+
+	body := "Use the link below to reset your Refactored Spoon password. It expires in one hour.\n\n" +
+		accountLink("reset-password", token) + "\n\n" +
+		"If you did not ask to reset your password you can ignore this email."
+	if err := s.mailer.Send(user.Email, "Reset your Refactored Spoon password", body); err != nil {
+		log.Println("unable to send password reset email to user " + user.ID.Hex() + ": " + err.Error())
+	}
+}
+
+// ResetPassword sets a new password using a password reset token and logs the user out everywhere
+func (s *server) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var resetReq resetPasswordRequest
+	err := decoder.Decode(&resetReq)
+	if err != nil {
+		lib.WriteDecodeError(w, r, "could not decode reset password request", err)
+		return
+	}
+
+	err = lib.Validate(resetReq)
+	if err != nil {
+		lib.WriteValidationError(w, r, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	userID, err := useAccountToken(ctx, s.users, resetReq.Token, passwordResetPurpose)
+	if err == errAccountTokenInvalid {
+		lib.WriteError(w, r, http.StatusBadRequest, lib.CodeBadRequest, err.Error(), nil)
+		return
+	}
+	if err != nil {
+		lib.WriteInternalError(w, r, "unable to use password reset token", err)
+		return
+	}
+
+	passwordHash, err := hashPassword(resetReq.Password)
+	if err != nil {
+		lib.WriteInternalError(w, r, "unable to hash password", err)
+		return
+	}
+
+	err = s.users.UpdatePassword(ctx, userID, passwordHash)
+	if err != nil {
+		lib.WriteInternalError(w, r, "unable to update password", err)
+		return
+	}
+
+	// resetting the password also proves ownership of the email
+	err = s.users.SetEmailVerified(ctx, userID)
+	if err != nil {
+		log.Println("unable to verify email of user " + userID.Hex() + ": " + err.Error())
+	}
+
+	err = s.sessions.RevokeSessions(ctx, userID.Hex())
+	if err != nil {
+		log.Println("unable to revoke sessions of user " + userID.Hex() + ": " + err.Error())
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// VerifyEmail marks the email of a user as verified using an email verification token
+func (s *server) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var verifyReq verifyEmailRequest
+	err := decoder.Decode(&verifyReq)
+	if err != nil {
+		lib.WriteDecodeError(w, r, "could not decode verify email request", err)
+		return
+	}
+
+	err = lib.Validate(verifyReq)
+	if err != nil {
+		lib.WriteValidationError(w, r, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	userID, err := useAccountToken(ctx, s.users, verifyReq.Token, emailVerificationPurpose)
+	if err == errAccountTokenInvalid {
+		lib.WriteError(w, r, http.StatusBadRequest, lib.CodeBadRequest, err.Error(), nil)
+		return
+	}
+	if err != nil {
+		lib.WriteInternalError(w, r, "unable to use email verification token", err)
+		return
+	}
+
+	err = s.users.SetEmailVerified(ctx, userID)
+	if err != nil {
+		lib.WriteInternalError(w, r, "unable to verify email", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sendVerificationEmail emails an email verification link to a newly signed up user
+// failures are only logged since the account has already been created
+func (s *server) sendVerificationEmail(ctx context.Context, userID primitive.ObjectID, email string) {
+	token, err := createAccountToken(ctx, s.users, userID, emailVerificationPurpose, emailVerificationTTL)
+	if err != nil {
+		log.Println("unable to create email verification token for user " + userID.Hex() + ": " + err.Error())
+		return
+	}
+
+	body := "Welcome to Refactored Spoon! Use the link below to verify your email address.\n\n" +
+		accountLink("verify-email", token)
+	if err := s.mailer.Send(email, "Verify your Refactored Spoon email", body); err != nil {
+		log.Println("unable to send verification email to user " + userID.Hex() + ": " + err.Error())
+	}
+}
+
+// createAccountToken stores a new single-use token for the user and returns the plaintext token
+func createAccountToken(ctx context.Context, users UserStore, userID primitive.ObjectID, purpose string, ttl time.Duration) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	err := users.CreateAccountToken(ctx, accountToken{
+		Hash:      hashAccountToken(token),
+		UserID:    userID,
+		Purpose:   purpose,
+		ExpiresAt: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// useAccountToken marks a token as used and returns the user it was issued to
+func useAccountToken(ctx context.Context, users UserStore, token string, purpose string) (primitive.ObjectID, error) {
+	if len(token) == 0 {
+		return primitive.NilObjectID, errAccountTokenInvalid
+	}
+	return users.UseAccountToken(ctx, hashAccountToken(token), purpose)
+}
+
+func hashAccountToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func accountLink(path string, token string) string {
+	base := appURL
+	if len(base) == 0 {
+		base = "https://jlight99.github.io/refactored-spoon"
+	}
+	return strings.TrimSuffix(base, "/") + "/" + path + "?token=" + token
+}
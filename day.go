@@ -3,17 +3,16 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"errors"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/refactored-spoon-backend/internal/lib"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // NutritionSummary contains information about all the nutrients
@@ -33,40 +32,80 @@ type NutritionSummary struct {
 	VitaminC    Nutrient `json:"vitaminC,omitempty" bson:"vitaminC,omitempty"`
 }
 
+// fields returns pointers to every nutrient of the summary keyed by its JSON field name
+func (n *NutritionSummary) fields() map[string]*Nutrient {
+	return map[string]*Nutrient{
+		"calories":    &n.Calories,
+		"protein":     &n.Protein,
+		"carbs":       &n.Carbs,
+		"fat":         &n.Fat,
+		"sugar":       &n.Sugar,
+		"fiber":       &n.Fiber,
+		"sodium":      &n.Sodium,
+		"calcium":     &n.Calcium,
+		"iron":        &n.Iron,
+		"cholesterol": &n.Cholesterol,
+		"potassium":   &n.Potassium,
+		"vitaminA":    &n.VitaminA,
+		"vitaminC":    &n.VitaminC,
+	}
+}
+
 // Nutrient contains information about a single nutrient
 type Nutrient struct {
-	NutrientName string  `json:"nutrientName,omitempty" bson:"nutrientName,omitempty"`
-	UnitName     string  `json:"unitName,omitempty" bson:"unitName,omitempty"`
-	Value        float64 `json:"value,omitempty" bson:"value,omitempty"`
+	NutrientName string  `json:"nutrientName,omitempty" bson:"nutrientName,omitempty" validate:"max=100"`
+	UnitName     string  `json:"unitName,omitempty" bson:"unitName,omitempty" validate:"max=20"`
+	Value        float64 `json:"value,omitempty" bson:"value,omitempty" validate:"min=0"`
 }
 
 // Food contains information such as name, group, serving size, and nutrition
 type Food struct {
 	ID            primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
-	Name          string             `json:"name,omitempty" bson:"name,omitempty"`
-	Group         string             `json:"group,omitempty" bson:"group,omitempty"`
-	Serving       int                `json:"serving,omitempty" bson:"serving,omitempty"`
-	Nutrition     NutritionSummary   `json:"nutrition,omitempty" bson:"nutrition,omitempty"`         // based on serving size
-	USDANutrition NutritionSummary   `json:"usdaNutrition,omitempty" bson:"usdaNutrition,omitempty"` // source of truth, based on nutrients / 100 g
+	Name          string             `json:"name,omitempty" bson:"name,omitempty" validate:"required,max=200"`
+	FdcId         int                `json:"fdcId,omitempty" bson:"fdcId,omitempty" validate:"min=0"` // FoodData Central ID of the food it was picked from, if any
+	Group         string             `json:"group,omitempty" bson:"group,omitempty" validate:"max=100"`
+	Serving       int                `json:"serving,omitempty" bson:"serving,omitempty" validate:"required,gt=0"` // grams
+	Nutrition     NutritionSummary   `json:"nutrition,omitempty" bson:"nutrition,omitempty"`                      // based on serving size
+	USDANutrition *NutritionSummary  `json:"usdaNutrition,omitempty" bson:"usdaNutrition,omitempty"`              // source of truth, based on nutrients / 100 g, nil if missing
 }
 
 // Meal contains the type of meal, a list of foods, and the nutrition summary of the meal
 type Meal struct {
 	ID        primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
-	Name      string             `json:"name,omitempty" bson:"name,omitempty"`
-	Foods     []Food             `json:"foods,omitempty" bson:"foods,omitempty"`
+	Name      string             `json:"name,omitempty" bson:"name,omitempty" validate:"required,max=100"`
+	Foods     []Food             `json:"foods,omitempty" bson:"foods,omitempty" validate:"max=100"`
 	Nutrition NutritionSummary   `json:"nutrition,omitempty" bson:"nutrition,omitempty"`
+	Version   int64              `json:"version,omitempty" bson:"version,omitempty"` // incremented on every change, returned as the ETag
 }
 
 // DayRecord is the representation of all the foods a user ate during a day as well as a nutrition summary
 type DayRecord struct {
 	ID        primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
-	Date      string             `json:"date,omitempty" bson:"date,omitempty"`
+	Date      string             `json:"date,omitempty" bson:"date,omitempty"` // YYYY-MM-DD
 	UserID    string             `json:"userId,omitempty" bson:"userId,omitempty"`
 	Meals     []Meal             `json:"meals,omitempty" bson:"meals,omitempty"`
 	Nutrition NutritionSummary   `json:"nutrition,omitempty" bson:"nutrition,omitempty"`
+	Version   int64              `json:"version,omitempty" bson:"version,omitempty"` // incremented on every change, returned as the ETag
+}
+
+// dayResponse is the body of GET /days/{date}, the day record along with progress towards the user's goals
+type dayResponse struct {
+	*DayRecord
+	Progress map[string]NutrientProgress `json:"progress,omitempty"`
 }
 
+// dayListResponse is the body of GET /days
+type dayListResponse struct {
+	Days     []DayRecord `json:"days"`
+	From     string      `json:"from"`
+	To       string      `json:"to"`
+	Page     int         `json:"page"`
+	PageSize int         `json:"pageSize"`
+	Total    int64       `json:"total"`
+}
+
+var errDayNotFound = errors.New("could not find day")
+
 // used to sort meals
 var mealValues = map[string]int{
 	"breakfast": 1,
@@ -74,50 +113,191 @@ var mealValues = map[string]int{
 	"dinner":    3,
 }
 
+const (
+	// dateLayout is how dates are stored so that they sort and range-scan correctly
+	dateLayout = "2006-01-02"
+	// legacyDateLayout is the ddmmyy format dates used to be stored and requested in
+	legacyDateLayout = "020106"
+
+	dayIndexName = "userId_1_date_1"
+
+	defaultDayPageSize = 31
+	maxDayPageSize     = 366
+)
+
+// DaysHandler handles /days GET requests listing the days of a date range
+func (s *server) DaysHandler(w http.ResponseWriter, r *http.Request) {
+	userID := lib.UserIDFromContext(r.Context())
+
+	switch r.Method {
+	case http.MethodGet:
+		getDays(w, r, s.days, userID)
+	}
+}
+
 // DayHandler handles /days/{dayId} GET and DELETE requests
-func DayHandler(w http.ResponseWriter, r *http.Request) {
+func (s *server) DayHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	date := vars["date"]
+	date, err := normalizeDate(vars["date"])
+	if err != nil {
+		writeDateError(w, r, "date", err)
+		return
+	}
 
-	collection := lib.GetCollection("Days")
-	userID := r.URL.Query().Get("userId")
+	userID := lib.UserIDFromContext(r.Context())
 
 	switch r.Method {
 	case http.MethodGet:
-		getDay(w, r, collection, userID, date)
+		getDay(w, r, s.days, s.users, userID, date)
 	case http.MethodDelete:
-		deleteDay(w, r, collection, userID, date)
+		deleteDay(w, r, s.days, userID, date)
 	}
 }
 
-func getDay(w http.ResponseWriter, r *http.Request, collection *mongo.Collection, userID string, date string) {
+func getDay(w http.ResponseWriter, r *http.Request, days DayStore, users UserStore, userID string, date string) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	dayRecord := GetDayByDate(ctx, collection, userID, date)
+	dayRecord, err := days.GetDay(ctx, userID, date)
+	if err == errDayNotFound {
+		lib.WriteError(w, r, http.StatusNotFound, lib.CodeNotFound, err.Error(), nil)
+		return
+	}
+	if err != nil {
+		lib.WriteInternalError(w, r, "could not find day", err)
+		return
+	}
 	sortMeals(dayRecord.Meals)
 
+	targets, err := GetDailyTargets(ctx, users, userID)
+	if err != nil {
+		lib.WriteInternalError(w, r, "could not find nutrition goals", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", lib.ETag(dayRecord.Version))
+	json.NewEncoder(w).Encode(dayResponse{DayRecord: dayRecord, Progress: computeProgress(targets, dayRecord.Nutrition)})
+}
+
+// getDays returns the days between the from and to query parameters inclusive, oldest first
+// summary=true leaves out the meals of each day and only returns its nutrition
+func getDays(w http.ResponseWriter, r *http.Request, days DayStore, userID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	query := r.URL.Query()
+	from, err := normalizeDate(query.Get("from"))
+	if err != nil {
+		writeDateError(w, r, "from", err)
+		return
+	}
+
+	to, err := normalizeDate(query.Get("to"))
+	if err != nil {
+		writeDateError(w, r, "to", err)
+		return
+	}
+
+	if to < from {
+		lib.WriteError(w, r, http.StatusBadRequest, lib.CodeBadRequest, "from date must not be after to date", nil)
+		return
+	}
+
+	page, err := queryInt(query.Get("page"), 1)
+	if err != nil || page < 1 {
+		lib.WriteError(w, r, http.StatusBadRequest, lib.CodeBadRequest, "page must be a positive integer", nil)
+		return
+	}
+
+	pageSize, err := queryInt(query.Get("pageSize"), defaultDayPageSize)
+	if err != nil || pageSize < 1 || pageSize > maxDayPageSize {
+		lib.WriteError(w, r, http.StatusBadRequest, lib.CodeBadRequest, "pageSize must be between 1 and "+strconv.Itoa(maxDayPageSize), nil)
+		return
+	}
+
+	dayRecords, total, err := days.ListDays(ctx, userID, DayQuery{
+		From:     from,
+		To:       to,
+		Page:     page,
+		PageSize: pageSize,
+		Summary:  query.Get("summary") == "true",
+	})
+	if err != nil {
+		lib.WriteInternalError(w, r, "could not find day results", err)
+		return
+	}
+	for i := range dayRecords {
+		sortMeals(dayRecords[i].Meals)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(dayRecord)
+	json.NewEncoder(w).Encode(dayListResponse{
+		Days:     dayRecords,
+		From:     from,
+		To:       to,
+		Page:     page,
+		PageSize: pageSize,
+		Total:    total,
+	})
 }
 
-func deleteDay(w http.ResponseWriter, r *http.Request, collection *mongo.Collection, userID string, date string) {
+func deleteDay(w http.ResponseWriter, r *http.Request, days DayStore, userID string, date string) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	collection.FindOneAndDelete(ctx, bson.M{"userId": userID, "date": date})
+	expectedVersions, err := lib.IfMatch(r)
+	if err != nil {
+		lib.WriteError(w, r, http.StatusBadRequest, lib.CodeBadRequest, err.Error(), nil)
+		return
+	}
+
+	err = days.DeleteDay(ctx, userID, date, expectedVersions)
+	if err != nil {
+		writeDayError(w, r, "unable to delete day", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeDayError responds with the status matching an error from changing a whole day,
+// message is only used for unexpected errors
+func writeDayError(w http.ResponseWriter, r *http.Request, message string, err error) {
+	switch err {
+	case errDayNotFound:
+		lib.WriteError(w, r, http.StatusNotFound, lib.CodeNotFound, err.Error(), nil)
+	case errDayModified:
+		lib.WriteError(w, r, http.StatusPreconditionFailed, lib.CodePreconditionFailed, err.Error(), nil)
+	default:
+		lib.WriteInternalError(w, r, message, err)
+	}
+}
+
+// writeDateError writes a 400 APIError for a date in the path or query string that does not parse
+func writeDateError(w http.ResponseWriter, r *http.Request, field string, err error) {
+	lib.WriteError(w, r, http.StatusBadRequest, lib.CodeBadRequest, "invalid "+field, lib.ValidationErrors{{Field: field, Message: err.Error()}})
 }
 
-// used in day.go:getDay, meal.go:postMeal, updateMeal, deleteMeal
-func GetDayByDate(ctx context.Context, collection *mongo.Collection, userID string, date string) *DayRecord {
-	var dayRecord DayRecord
-	err := collection.FindOne(ctx, bson.M{"userId": userID, "date": date}).Decode(&dayRecord)
+// normalizeDate converts a YYYY-MM-DD or legacy ddmmyy date to YYYY-MM-DD
+func normalizeDate(date string) (string, error) {
+	layout := dateLayout
+	if len(date) == len(legacyDateLayout) {
+		layout = legacyDateLayout
+	}
+
+	parsed, err := time.Parse(layout, date)
 	if err != nil {
-		log.Println("error in finding day with userId: " + userID + " date: " + date)
-		log.Println(err)
-		return &DayRecord{}
+		return "", errors.New("date must be in YYYY-MM-DD format: " + date)
+	}
+	return parsed.Format(dateLayout), nil
+}
+
+func queryInt(value string, defaultValue int) (int, error) {
+	if len(value) == 0 {
+		return defaultValue, nil
 	}
-	return &dayRecord
+	return strconv.Atoi(value)
 }
 
 func sortMeals(meals []Meal) {
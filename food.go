@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/refactored-spoon-backend/internal/lib"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var errFoodNotFound = errors.New("could not find food")
+
+// servingRequest is the body for PUT /days/{date}/meals/{mealId}/foods/{foodId}, only the serving of a food can change
+type servingRequest struct {
+	Serving int `json:"serving,omitempty" validate:"required,gt=0"` // grams
+}
+
+// FoodsHandler handles /days/{date}/meals/{mealId}/foods GET, POST and DELETE requests
+func (s *server) FoodsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	date, err := normalizeDate(vars["date"])
+	if err != nil {
+		writeDateError(w, r, "date", err)
+		return
+	}
+
+	mealID, err := primitive.ObjectIDFromHex(vars["mealId"])
+	if err != nil {
+		lib.WriteError(w, r, http.StatusBadRequest, lib.CodeBadRequest, "invalid meal ID provided: "+vars["mealId"], nil)
+		return
+	}
+
+	userID := lib.UserIDFromContext(r.Context())
+
+	switch r.Method {
+	case http.MethodGet:
+		getFoods(w, r, s.days, userID, date, mealID)
+	case http.MethodPost:
+		postFood(w, r, s.days, userID, date, mealID)
+	case http.MethodDelete:
+		deleteFoods(w, r, s.days, userID, date, mealID)
+	}
+}
+
+// FoodHandler handles /days/{date}/meals/{mealId}/foods/{foodId} GET, PUT and DELETE requests
+func (s *server) FoodHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	date, err := normalizeDate(vars["date"])
+	if err != nil {
+		writeDateError(w, r, "date", err)
+		return
+	}
+
+	mealID, err := primitive.ObjectIDFromHex(vars["mealId"])
+	if err != nil {
+		lib.WriteError(w, r, http.StatusBadRequest, lib.CodeBadRequest, "invalid meal ID provided: "+vars["mealId"], nil)
+		return
+	}
+
+	foodID, err := primitive.ObjectIDFromHex(vars["foodId"])
+	if err != nil {
+		lib.WriteError(w, r, http.StatusBadRequest, lib.CodeBadRequest, "invalid food ID provided: "+vars["foodId"], nil)
+		return
+	}
+
+	userID := lib.UserIDFromContext(r.Context())
+
+	switch r.Method {
+	case http.MethodGet:
+		getFood(w, r, s.days, userID, date, mealID, foodID)
+	case http.MethodPut:
+		updateFood(w, r, s.days, userID, date, mealID, foodID)
+	case http.MethodDelete:
+		deleteFood(w, r, s.days, userID, date, mealID, foodID)
+	}
+}
+
+func getFoods(w http.ResponseWriter, r *http.Request, days DayStore, userID string, date string, mealID primitive.ObjectID) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	meal, err := findDayMeal(ctx, days, userID, date, mealID)
+	if err != nil {
+		writeMealError(w, r, "could not find meal", err)
+		return
+	}
+
+	foods := meal.Foods
+	if foods == nil {
+		foods = make([]Food, 0)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", lib.ETag(meal.Version))
+	json.NewEncoder(w).Encode(foods)
+}
+
+func getFood(w http.ResponseWriter, r *http.Request, days DayStore, userID string, date string, mealID primitive.ObjectID, foodID primitive.ObjectID) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	meal, err := findDayMeal(ctx, days, userID, date, mealID)
+	if err != nil {
+		writeMealError(w, r, "could not find meal", err)
+		return
+	}
+
+	for _, food := range meal.Foods {
+		if food.ID == foodID {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("ETag", lib.ETag(meal.Version))
+			json.NewEncoder(w).Encode(food)
+			return
+		}
+	}
+
+	lib.WriteError(w, r, http.StatusNotFound, lib.CodeNotFound, errFoodNotFound.Error(), nil)
+}
+
+func postFood(w http.ResponseWriter, r *http.Request, days DayStore, userID string, date string, mealID primitive.ObjectID) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	decoder := json.NewDecoder(r.Body)
+	var food Food
+	err := decoder.Decode(&food)
+	if err != nil {
+		lib.WriteDecodeError(w, r, "could not decode post food request", err)
+		return
+	}
+
+	err = lib.Validate(food)
+	if err != nil {
+		lib.WriteValidationError(w, r, err)
+		return
+	}
+
+	// nutrition is always derived from the USDA nutrition and serving of the food
+	err = computeFoodNutrition(&food)
+	if err != nil {
+		writeMealError(w, r, "invalid food", err)
+		return
+	}
+	food.ID = primitive.NewObjectID()
+
+	meal, err := mutateFoods(ctx, w, r, days, userID, date, mealID, func(foods []Food) ([]Food, error) {
+		return append(foods, food), nil
+	})
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", lib.ETag(meal.Version))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(food)
+}
+
+// updateFood changes the serving size of a food and rescales its nutrition from its USDA nutrition
+func updateFood(w http.ResponseWriter, r *http.Request, days DayStore, userID string, date string, mealID primitive.ObjectID, foodID primitive.ObjectID) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	decoder := json.NewDecoder(r.Body)
+	var foodReq servingRequest
+	err := decoder.Decode(&foodReq)
+	if err != nil {
+		lib.WriteDecodeError(w, r, "could not decode update food request", err)
+		return
+	}
+
+	err = lib.Validate(foodReq)
+	if err != nil {
+		lib.WriteValidationError(w, r, err)
+		return
+	}
+
+	var updated Food
+	meal, err := mutateFoods(ctx, w, r, days, userID, date, mealID, func(foods []Food) ([]Food, error) {
+		for i := range foods {
+			if foods[i].ID == foodID {
+				foods[i].Serving = foodReq.Serving
+				if err := computeFoodNutrition(&foods[i]); err != nil {
+					return nil, err
+				}
+				updated = foods[i]
+				return foods, nil
+			}
+		}
+		return nil, errFoodNotFound
+	})
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", lib.ETag(meal.Version))
+	json.NewEncoder(w).Encode(updated)
+}
+
+func deleteFood(w http.ResponseWriter, r *http.Request, days DayStore, userID string, date string, mealID primitive.ObjectID, foodID primitive.ObjectID) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	meal, err := mutateFoods(ctx, w, r, days, userID, date, mealID, func(foods []Food) ([]Food, error) {
+		for i := range foods {
+			if foods[i].ID == foodID {
+				return append(foods[:i], foods[i+1:]...), nil
+			}
+		}
+		return nil, errFoodNotFound
+	})
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("ETag", lib.ETag(meal.Version))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func deleteFoods(w http.ResponseWriter, r *http.Request, days DayStore, userID string, date string, mealID primitive.ObjectID) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	meal, err := mutateFoods(ctx, w, r, days, userID, date, mealID, func(foods []Food) ([]Food, error) {
+		return []Food{}, nil
+	})
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("ETag", lib.ETag(meal.Version))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// mutateFoods atomically replaces the foods of a meal with the result of mutate and recomputes the meal nutrition,
+// which in turn adjusts the day nutrition
+// errors are written to the response, callers only need to return when err is not nil
+func mutateFoods(ctx context.Context, w http.ResponseWriter, r *http.Request, days DayStore, userID string, date string, mealID primitive.ObjectID, mutate func(foods []Food) ([]Food, error)) (*Meal, error) {
+	expectedVersions, err := lib.IfMatch(r)
+	if err != nil {
+		lib.WriteError(w, r, http.StatusBadRequest, lib.CodeBadRequest, err.Error(), nil)
+		return nil, err
+	}
+
+	meal, err := days.MutateMeal(ctx, userID, date, mealID, expectedVersions, func(original Meal) (*Meal, error) {
+		foods, err := mutate(append([]Food{}, original.Foods...))
+		if err != nil {
+			return nil, err
+		}
+
+		original.Foods = foods
+		original.Nutrition = sumFoodNutrition(foods)
+		return &original, nil
+	})
+	if err != nil {
+		writeMealError(w, r, "unable to update meal foods", err)
+	}
+	return meal, err
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/refactored-spoon-backend/internal/fdc"
+)
+
+const (
+	// USDA foods rarely change, search results change as foods are added
+	foodSearchCacheTTL = 24 * time.Hour
+	foodDetailCacheTTL = 30 * 24 * time.Hour
+
+	// foodCacheStaleFor is how long past its TTL a response is kept to answer with while USDA is failing
+	foodCacheStaleFor = 7 * 24 * time.Hour
+
+	// defaultFoodCacheSize is how many responses are kept in memory in front of the FoodCache collection
+	defaultFoodCacheSize = 1000
+
+	// defaultFoodSearchPageSize is the page size USDA uses when none is given
+	defaultFoodSearchPageSize = 50
+
+	// foodCacheStatusHeader tells clients whether a response was served from the cache: HIT, MISS, STALE or BYPASS
+	foodCacheStatusHeader = "X-Cache"
+)
+
+// FoodCacheStats counts how USDA lookups were served since the process started
+type FoodCacheStats struct {
+	MemoryHits int64   `json:"memoryHits"`
+	StoreHits  int64   `json:"storeHits"`
+	Misses     int64   `json:"misses"`
+	StaleHits  int64   `json:"staleHits"` // misses answered with an expired response because USDA failed
+	Bypasses   int64   `json:"bypasses"`
+	Errors     int64   `json:"errors"`  // cache store failures, the lookup falls through to USDA
+	HitRate    float64 `json:"hitRate"` // share of non-bypassed lookups served from either cache level
+	Entries    int     `json:"entries"` // responses currently held in memory
+}
+
+// CachedFoodSource is a FoodSource that remembers the responses of another, first in an in-memory LRU
+// and then in a FoodCacheStore, only successful responses are cached
+// expired responses are kept for a while longer and served if the source fails, except for unknown foods
+type CachedFoodSource struct {
+	source FoodSource
+	store  FoodCacheStore
+	recent *lruCache
+	now    func() time.Time
+
+	memoryHits int64
+	storeHits  int64
+	misses     int64
+	staleHits  int64
+	bypasses   int64
+	errors     int64
+}
+
+// NewCachedFoodSource returns a FoodSource caching the responses of source, keeping up to size of them in memory
+func NewCachedFoodSource(source FoodSource, store FoodCacheStore, size int) *CachedFoodSource {
+	return &CachedFoodSource{source: source, store: store, recent: newLRUCache(size), now: time.Now}
+}
+
+// Search returns a page of the foods matching the search criteria
+// criteria that only differ in case, whitespace or defaults share a cache entry
+func (c *CachedFoodSource) Search(ctx context.Context, criteria fdc.FoodSearchCriteria) (*fdc.FoodSearchResult, error) {
+	criteria = normalizeSearchCriteria(criteria)
+	key, err := searchCacheKey(criteria)
+	if err != nil {
+		return nil, err
+	}
+
+	var result fdc.FoodSearchResult
+	err = c.get(ctx, key, foodSearchCacheTTL, &result, func() (interface{}, error) {
+		return c.source.Search(ctx, criteria)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Food returns the details of the food with the given FoodData Central ID
+func (c *CachedFoodSource) Food(ctx context.Context, fdcID int) (*fdc.FoodDetailResult, error) {
+	var result fdc.FoodDetailResult
+	err := c.get(ctx, foodCacheKey(fdcID), foodDetailCacheTTL, &result, func() (interface{}, error) {
+		return c.source.Food(ctx, fdcID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Foods returns the details of the foods with the given FoodData Central IDs in the order they were asked for,
+// each food is cached on its own so only the foods missing from the cache are fetched
+func (c *CachedFoodSource) Foods(ctx context.Context, fdcIDs []int) ([]fdc.FoodDetailResult, error) {
+	found := make(map[int]fdc.FoodDetailResult)
+	stale := make(map[int][]byte)
+	var missing []int
+	// each distinct ID is looked up once, so that missing lists every food to fetch once
+	seen := make(map[int]bool)
+	for _, fdcID := range fdcIDs {
+		if seen[fdcID] {
+			continue
+		}
+		seen[fdcID] = true
+
+		var food fdc.FoodDetailResult
+		value, fresh := c.lookup(ctx, foodCacheKey(fdcID))
+		switch {
+		case fresh && json.Unmarshal(value, &food) == nil:
+			found[fdcID] = food
+		case value != nil:
+			stale[fdcID] = value
+			missing = append(missing, fdcID)
+		default:
+			missing = append(missing, fdcID)
+		}
+	}
+
+	if len(missing) > 0 {
+		fetched, err := c.source.Foods(ctx, missing)
+		if err != nil {
+			// only answer with stale foods if every missing food has one, rather than silently leaving foods out
+			if len(stale) < len(missing) {
+				return nil, err
+			}
+			for fdcID, value := range stale {
+				var food fdc.FoodDetailResult
+				if json.Unmarshal(value, &food) != nil {
+					return nil, err
+				}
+				found[fdcID] = food
+			}
+			c.servedStale(ctx, err)
+		}
+		for _, food := range fetched {
+			found[food.FdcId] = food
+			if value, err := json.Marshal(food); err == nil {
+				c.save(ctx, foodCacheKey(food.FdcId), value, foodDetailCacheTTL)
+			}
+		}
+	}
+
+	// USDA leaves out unknown IDs
+	foods := make([]fdc.FoodDetailResult, 0, len(fdcIDs))
+	for _, fdcID := range fdcIDs {
+		if food, ok := found[fdcID]; ok {
+			foods = append(foods, food)
+		}
+	}
+	return foods, nil
+}
+
+// Stats returns the cache hit counts so far
+func (c *CachedFoodSource) Stats() FoodCacheStats {
+	stats := FoodCacheStats{
+		MemoryHits: atomic.LoadInt64(&c.memoryHits),
+		StoreHits:  atomic.LoadInt64(&c.storeHits),
+		Misses:     atomic.LoadInt64(&c.misses),
+		StaleHits:  atomic.LoadInt64(&c.staleHits),
+		Bypasses:   atomic.LoadInt64(&c.bypasses),
+		Errors:     atomic.LoadInt64(&c.errors),
+		Entries:    c.recent.len(),
+	}
+	if lookups := stats.MemoryHits + stats.StoreHits + stats.Misses; lookups > 0 {
+		stats.HitRate = float64(stats.MemoryHits+stats.StoreHits) / float64(lookups)
+	}
+	return stats
+}
+
+// get decodes the fresh cached value of key into v, or else fetches and caches it,
+// answering with the stale cached value if fetching fails
+func (c *CachedFoodSource) get(ctx context.Context, key string, ttl time.Duration, v interface{}, fetch func() (interface{}, error)) error {
+	value, fresh := c.lookup(ctx, key)
+	if fresh && json.Unmarshal(value, v) == nil {
+		return nil
+	}
+
+	fetched, err := fetch()
+	if err != nil {
+		if value == nil || fdc.IsNotFound(err) || json.Unmarshal(value, v) != nil {
+			return err
+		}
+		c.servedStale(ctx, err)
+		return nil
+	}
+
+	encoded, err := json.Marshal(fetched)
+	if err != nil {
+		return err
+	}
+	c.save(ctx, key, encoded, ttl)
+	return json.Unmarshal(encoded, v)
+}
+
+// lookup returns the cached value of key, if any, and whether it is still fresh
+// cache store failures are only logged since USDA can still answer
+func (c *CachedFoodSource) lookup(ctx context.Context, key string) ([]byte, bool) {
+	status := foodCacheStatusFromContext(ctx)
+	if status.bypass {
+		atomic.AddInt64(&c.bypasses, 1)
+		return nil, false
+	}
+
+	now := c.now()
+	value, expiresAt, ok := c.recent.get(key, now)
+	if ok && c.fresh(expiresAt, now) {
+		atomic.AddInt64(&c.memoryHits, 1)
+		status.record(cacheHit)
+		return value, true
+	}
+
+	// another process may have refreshed a value that went stale in memory
+	// the store judges expiry by the wall clock rather than c.now
+	stored, storedExpiresAt, err := c.store.GetCachedFood(ctx, key)
+	if err == nil && !storedExpiresAt.After(now) {
+		err = errCacheMiss
+	}
+	if err == nil {
+		value, expiresAt = stored, storedExpiresAt
+		c.recent.add(key, value, expiresAt)
+		if c.fresh(expiresAt, now) {
+			atomic.AddInt64(&c.storeHits, 1)
+			status.record(cacheHit)
+			return value, true
+		}
+	} else if err != errCacheMiss {
+		atomic.AddInt64(&c.errors, 1)
+		log.Println("unable to read food cache entry " + key + ": " + err.Error())
+	}
+
+	atomic.AddInt64(&c.misses, 1)
+	status.record(cacheMiss)
+	return value, false
+}
+
+// fresh reports whether a value that is kept until expiresAt is still within its TTL
+func (c *CachedFoodSource) fresh(expiresAt time.Time, now time.Time) bool {
+	return expiresAt.Add(-foodCacheStaleFor).After(now)
+}
+
+// servedStale records that a lookup was answered with a stale value because the source failed with err
+func (c *CachedFoodSource) servedStale(ctx context.Context, err error) {
+	atomic.AddInt64(&c.staleHits, 1)
+	foodCacheStatusFromContext(ctx).record(cacheStale)
+	log.Println("serving stale USDA response: " + err.Error())
+}
+
+// save caches an encoded response in memory and in the store, keeping it past its TTL in case the source fails later
+func (c *CachedFoodSource) save(ctx context.Context, key string, value []byte, ttl time.Duration) {
+	expiresAt := c.now().Add(ttl + foodCacheStaleFor)
+	c.recent.add(key, value, expiresAt)
+	if err := c.store.SetCachedFood(ctx, key, value, expiresAt); err != nil {
+		atomic.AddInt64(&c.errors, 1)
+		log.Println("unable to write food cache entry " + key + ": " + err.Error())
+	}
+}
+
+// normalizeSearchCriteria lowercases and collapses the whitespace of the search input, sorts the data types,
+// drops a sort order without a sort field and fills in USDA's defaults
+func normalizeSearchCriteria(criteria fdc.FoodSearchCriteria) fdc.FoodSearchCriteria {
+	criteria.GeneralSearchInput = strings.Join(strings.Fields(strings.ToLower(criteria.GeneralSearchInput)), " ")
+	criteria.BrandOwner = strings.Join(strings.Fields(criteria.BrandOwner), " ")
+	if len(criteria.DataType) > 0 {
+		criteria.DataType = append([]string(nil), criteria.DataType...)
+		sort.Strings(criteria.DataType)
+	}
+	if criteria.PageNumber <= 0 {
+		criteria.PageNumber = 1
+	}
+	if criteria.PageSize <= 0 {
+		criteria.PageSize = defaultFoodSearchPageSize
+	}
+	if len(criteria.SortBy) == 0 {
+		criteria.SortOrder = ""
+	}
+	return criteria
+}
+
+// searchCacheKey encodes every field of normalized criteria, so that new criteria fields become part of the key
+func searchCacheKey(criteria fdc.FoodSearchCriteria) (string, error) {
+	encoded, err := json.Marshal(criteria)
+	if err != nil {
+		return "", err
+	}
+	return "search:" + string(encoded), nil
+}
+
+func foodCacheKey(fdcID int) string {
+	return "food:" + strconv.Itoa(fdcID)
+}
+
+type foodCacheStatusContextKey struct{}
+
+// outcomes of a cache lookup
+const (
+	cacheHit = iota
+	cacheMiss
+	cacheStale
+)
+
+// foodCacheStatus tracks how the lookups made for a single request were served
+type foodCacheStatus struct {
+	bypass bool
+	hits   int32
+	misses int32
+	stale  int32
+}
+
+// withFoodCacheStatus returns a context that skips cached responses if the request asked for fresh data
+// with "Cache-Control: no-cache", fresh responses are still cached
+func withFoodCacheStatus(r *http.Request) (context.Context, *foodCacheStatus) {
+	status := &foodCacheStatus{bypass: strings.Contains(strings.ToLower(r.Header.Get("Cache-Control")), "no-cache")}
+	return context.WithValue(r.Context(), foodCacheStatusContextKey{}, status), status
+}
+
+func foodCacheStatusFromContext(ctx context.Context) *foodCacheStatus {
+	if status, ok := ctx.Value(foodCacheStatusContextKey{}).(*foodCacheStatus); ok {
+		return status
+	}
+	return &foodCacheStatus{}
+}
+
+func (s *foodCacheStatus) record(outcome int) {
+	switch outcome {
+	case cacheHit:
+		atomic.AddInt32(&s.hits, 1)
+	case cacheMiss:
+		atomic.AddInt32(&s.misses, 1)
+	case cacheStale:
+		atomic.AddInt32(&s.stale, 1)
+	}
+}
+
+// setHeader sets the X-Cache header, a response counts as a hit only if every lookup for it was
+// and as stale if any part of it is
+func (s *foodCacheStatus) setHeader(w http.ResponseWriter) {
+	switch {
+	case s.bypass:
+		w.Header().Set(foodCacheStatusHeader, "BYPASS")
+	case atomic.LoadInt32(&s.stale) > 0:
+		w.Header().Set(foodCacheStatusHeader, "STALE")
+	case atomic.LoadInt32(&s.misses) > 0:
+		w.Header().Set(foodCacheStatusHeader, "MISS")
+	case atomic.LoadInt32(&s.hits) > 0:
+		w.Header().Set(foodCacheStatusHeader, "HIT")
+	}
+}
+
+// lruCache holds the most recently used values up to a fixed number of entries, safe for concurrent use
+type lruCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // most recently used at the front
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+func newLRUCache(size int) *lruCache {
+	return &lruCache{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// get returns the value of key and when it expires, if it has not expired by now
+func (c *lruCache) get(key string, now time.Time) ([]byte, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	entry := element.Value.(*lruEntry)
+	if !entry.expiresAt.After(now) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil, time.Time{}, false
+	}
+
+	c.order.MoveToFront(element)
+	return entry.value, entry.expiresAt, true
+}
+
+// add stores value under key, evicting the least recently used entry if the cache is full
+func (c *lruCache) add(key string, value []byte, expiresAt time.Time) {
+	if c.size <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		element.Value = &lruEntry{key: key, value: value, expiresAt: expiresAt}
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value, expiresAt: expiresAt})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (c *lruCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
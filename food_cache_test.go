@@ -0,0 +1,224 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/refactored-spoon-backend/internal/fdc"
+)
+
+// countingUSDA is a fake FoodData Central server that records the requests it gets
+type countingUSDA struct {
+	mu       sync.Mutex
+	requests []string // path and query of each request
+	failing  bool
+}
+
+func (u *countingUSDA) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	u.requests = append(u.requests, r.URL.RequestURI())
+	failing := u.failing
+	u.mu.Unlock()
+
+	if failing {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/foods/search":
+		w.Write([]byte(usdaSearchResponse))
+	case "/food/1105314":
+		w.Write([]byte(usdaFoodResponse))
+	case "/foods":
+		// only 1105314 is a known food
+		if r.URL.Query().Get("fdcIds") == "42" {
+			w.Write([]byte(`[]`))
+			return
+		}
+		w.Write([]byte("[" + usdaFoodResponse + "]"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (u *countingUSDA) lastRequest() (string, int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.requests) == 0 {
+		return "", 0
+	}
+	return u.requests[len(u.requests)-1], len(u.requests)
+}
+
+func TestFoodCache(t *testing.T) {
+	usda := &countingUSDA{}
+	usdaServer := httptest.NewServer(usda)
+	defer usdaServer.Close()
+
+	s, _ := newTestServer(t)
+	store := NewMemoryFoodCacheStore()
+	client := newTestUSDAClient(usdaServer.URL)
+	client.Retries = 0 // retries are covered by TestUSDARetries
+	cache := NewCachedFoodSource(client, store, 10)
+	s.foods = cache
+	h := s.Handler()
+
+	noCache := map[string]string{"Cache-Control": "no-cache"}
+
+	tests := []struct {
+		name        string
+		path        string
+		body        interface{}
+		header      map[string]string
+		failing     bool
+		want        int
+		wantCache   string
+		wantRequest string // the USDA request made, empty if none
+	}{
+		{name: "search miss", path: "/food/search", body: fdc.FoodSearchCriteria{GeneralSearchInput: "Banana"}, want: http.StatusOK, wantCache: "MISS", wantRequest: "/foods/search"},
+		{name: "search hit with different case and defaults", path: "/food/search", body: fdc.FoodSearchCriteria{GeneralSearchInput: "  banana ", PageNumber: 1, PageSize: 50}, want: http.StatusOK, wantCache: "HIT"},
+		{name: "search bypass", path: "/food/search", body: fdc.FoodSearchCriteria{GeneralSearchInput: "banana"}, header: noCache, want: http.StatusOK, wantCache: "BYPASS", wantRequest: "/foods/search"},
+		{name: "other page misses", path: "/food/search", body: fdc.FoodSearchCriteria{GeneralSearchInput: "banana", PageNumber: 2}, want: http.StatusOK, wantCache: "MISS", wantRequest: "/foods/search"},
+		{name: "failed search", path: "/food/search", body: fdc.FoodSearchCriteria{GeneralSearchInput: "apple"}, failing: true, want: http.StatusBadGateway, wantRequest: "/foods/search"},
+		{name: "failed search is not cached", path: "/food/search", body: fdc.FoodSearchCriteria{GeneralSearchInput: "apple"}, want: http.StatusOK, wantCache: "MISS", wantRequest: "/foods/search"},
+
+		{name: "detail miss", path: "/food/detail", body: FoodDetailRequest{FdcId: 1105314}, want: http.StatusOK, wantCache: "MISS", wantRequest: "/food/1105314"},
+		{name: "detail hit", path: "/food/detail", body: FoodDetailRequest{FdcId: 1105314}, want: http.StatusOK, wantCache: "HIT"},
+		{name: "foods detail reuses cached food", path: "/foods/detail", body: FoodsDetailRequest{FdcIds: []int{1105314, 42}}, want: http.StatusOK, wantCache: "MISS", wantRequest: "/foods?fdcIds=42"},
+		{name: "unknown foods are not cached", path: "/foods/detail", body: FoodsDetailRequest{FdcIds: []int{42}}, want: http.StatusOK, wantCache: "MISS", wantRequest: "/foods?fdcIds=42"},
+		{name: "foods detail hit", path: "/foods/detail", body: FoodsDetailRequest{FdcIds: []int{1105314}}, want: http.StatusOK, wantCache: "HIT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usda.mu.Lock()
+			usda.failing = tt.failing
+			usda.mu.Unlock()
+			_, before := usda.lastRequest()
+
+			w := serve(t, h, http.MethodPost, tt.path, "", tt.body, tt.header)
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+			if got := w.Header().Get(foodCacheStatusHeader); got != tt.wantCache {
+				t.Errorf("got %s %q, want %q", foodCacheStatusHeader, got, tt.wantCache)
+			}
+
+			request, after := usda.lastRequest()
+			switch {
+			case len(tt.wantRequest) == 0 && after != before:
+				t.Errorf("got USDA request %s, want none", request)
+			case len(tt.wantRequest) > 0 && (after != before+1 || request != tt.wantRequest):
+				t.Errorf("got %d USDA requests ending with %s, want 1 request %s", after-before, request, tt.wantRequest)
+			}
+		})
+	}
+
+	stats := cache.Stats()
+	if stats.MemoryHits != 4 || stats.StoreHits != 0 || stats.Misses != 7 || stats.Bypasses != 1 {
+		t.Errorf("got stats %+v", stats)
+	}
+
+	// a new process starts with an empty memory cache but shares the store
+	restarted := NewCachedFoodSource(client, store, 10)
+	s.foods = restarted
+	w := serve(t, s.Handler(), http.MethodPost, "/food/detail", "", FoodDetailRequest{FdcId: 1105314}, nil)
+	if got := w.Header().Get(foodCacheStatusHeader); got != "HIT" {
+		t.Errorf("got %s %q after restart, want HIT", foodCacheStatusHeader, got)
+	}
+	if stats := restarted.Stats(); stats.StoreHits != 1 || stats.Entries != 1 {
+		t.Errorf("got stats %+v after restart", stats)
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	now := time.Now()
+	cache := newLRUCache(2)
+	cache.add("a", []byte("1"), now.Add(time.Hour))
+	cache.add("b", []byte("2"), now.Add(time.Hour))
+
+	// reading a makes b the least recently used
+	if _, _, ok := cache.get("a", now); !ok {
+		t.Fatal("a was evicted")
+	}
+	cache.add("c", []byte("3"), now.Add(time.Hour))
+	if _, _, ok := cache.get("b", now); ok {
+		t.Error("b was not evicted")
+	}
+	if _, _, ok := cache.get("a", now); !ok {
+		t.Error("a was evicted")
+	}
+
+	if _, _, ok := cache.get("c", now.Add(2*time.Hour)); ok {
+		t.Error("c was served after expiring")
+	}
+	if cache.len() != 1 {
+		t.Errorf("got %d entries, want 1", cache.len())
+	}
+}
+
+func TestFoodCacheServesStale(t *testing.T) {
+	usda := &countingUSDA{}
+	usdaServer := httptest.NewServer(usda)
+	defer usdaServer.Close()
+
+	s, _ := newTestServer(t)
+	client := newTestUSDAClient(usdaServer.URL)
+	client.Retries = 0
+	client.Breaker = nil
+	cache := NewCachedFoodSource(client, NewMemoryFoodCacheStore(), 10)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	s.foods = cache
+	h := s.Handler()
+
+	detail := func(fdcID int) *httptest.ResponseRecorder {
+		return serve(t, h, http.MethodPost, "/food/detail", "", FoodDetailRequest{FdcId: fdcID}, nil)
+	}
+
+	if w := detail(1105314); w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	usda.mu.Lock()
+	usda.failing = true
+	usda.mu.Unlock()
+
+	tests := []struct {
+		name      string
+		age       time.Duration
+		want      int
+		wantCache string
+	}{
+		{name: "fresh", age: foodDetailCacheTTL - time.Minute, want: http.StatusOK, wantCache: "HIT"},
+		{name: "expired while USDA fails", age: foodDetailCacheTTL + time.Minute, want: http.StatusOK, wantCache: "STALE"},
+		{name: "too old to serve", age: foodDetailCacheTTL + foodCacheStaleFor + time.Minute, want: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = time.Now().Add(tt.age)
+			w := detail(1105314)
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+			if got := w.Header().Get(foodCacheStatusHeader); got != tt.wantCache {
+				t.Errorf("got %s %q, want %q", foodCacheStatusHeader, got, tt.wantCache)
+			}
+		})
+	}
+
+	// a food asked for twice still has a stale copy for every distinct ID
+	now = time.Now().Add(foodDetailCacheTTL + time.Minute)
+	w := serve(t, h, http.MethodPost, "/foods/detail", "", FoodsDetailRequest{FdcIds: []int{1105314, 1105314}}, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d for repeated IDs, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+
+	if stats := cache.Stats(); stats.StaleHits != 2 {
+		t.Errorf("got stats %+v", stats)
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/refactored-spoon-backend/internal/fdc"
+)
+
+// weights of the fields of a food, a word of the description says more about a food than one of its ingredients
+const (
+	descriptionWeight = 3.0
+	brandOwnerWeight  = 2.0
+	ingredientsWeight = 1.0
+)
+
+// how well a word of a food has to match a search word, relative to an exact match
+const (
+	prefixMatch    = 0.8 // the search word is the start of the word, e.g. while it is being typed
+	oneTypoMatch   = 0.6
+	twoTyposMatch  = 0.4
+	minPrefixRunes = 2 // shorter search words only match whole words
+	minFuzzyRunes  = 4 // shorter search words only match without typos
+	twoTyposRunes  = 8 // search words at least this long may have two typos
+)
+
+// loggedFoodsDays is how far back the foods a user logged are boosted in their searches
+const loggedFoodsDays = 90
+
+// field flags of a posting
+const (
+	inDescription = 1 << iota
+	inBrandOwner
+	inIngredients
+)
+
+// foodIndex is an inverted index of the words in the descriptions, brand owners and ingredients of foods
+// it is immutable once built so that searches need no locking
+type foodIndex struct {
+	foods    []indexedFood
+	terms    []string    // the vocabulary, sorted for prefix lookups
+	postings [][]posting // by term, ordered by food
+	byLength map[int][]int
+}
+
+// indexedFood is what the index keeps of a food to filter and rank it, the rest is read from the store
+type indexedFood struct {
+	fdcID      int
+	dataType   string
+	brandOwner string // lowercased
+	name       string // normalized description, to recognize foods logged before they had an fdcId
+	words      int    // in the description, shorter descriptions are closer matches
+	published  time.Time
+}
+
+type posting struct {
+	food   int32
+	fields uint8
+}
+
+// buildFoodIndex indexes every food in store
+func buildFoodIndex(ctx context.Context, store FoodStore) (*foodIndex, error) {
+	index := &foodIndex{byLength: make(map[int][]int)}
+	postings := make(map[string][]posting)
+	err := store.EachFood(ctx, func(food fdc.FoodDetailResult) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		description := searchTerms(food.Description)
+		fields := make(map[string]uint8)
+		for _, term := range description {
+			fields[term] |= inDescription
+		}
+		for _, term := range searchTerms(food.BrandOwner) {
+			fields[term] |= inBrandOwner
+		}
+		for _, term := range searchTerms(food.Ingredients) {
+			fields[term] |= inIngredients
+		}
+
+		position := int32(len(index.foods))
+		for term, flags := range fields {
+			postings[term] = append(postings[term], posting{food: position, fields: flags})
+		}
+		published, _ := food.Published()
+		index.foods = append(index.foods, indexedFood{
+			fdcID:      food.FdcId,
+			dataType:   food.DataType,
+			brandOwner: normalizeFoodName(food.BrandOwner),
+			name:       normalizeFoodName(food.Description),
+			words:      len(description),
+			published:  published,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	index.terms = make([]string, 0, len(postings))
+	for term := range postings {
+		index.terms = append(index.terms, term)
+	}
+	sort.Strings(index.terms)
+	index.postings = make([][]posting, len(index.terms))
+	for i, term := range index.terms {
+		index.postings[i] = postings[term]
+		length := utf8.RuneCountInString(term)
+		index.byLength[length] = append(index.byLength[length], i)
+	}
+	return index, nil
+}
+
+// foodSearch is a search of the index
+type foodSearch struct {
+	criteria fdc.FoodSearchCriteria // normalized
+	logged   loggedFoods
+}
+
+// search returns the fdcIds of the requested page of matching foods, best matches first, and how many foods match
+func (index *foodIndex) search(query foodSearch) ([]int, int) {
+	terms := searchTerms(query.criteria.GeneralSearchInput)
+	if len(terms) == 0 {
+		return []int{}, 0
+	}
+
+	dataTypes := make(map[string]bool, len(query.criteria.DataType))
+	for _, dataType := range query.criteria.DataType {
+		dataTypes[dataType] = true
+	}
+	brandOwner := normalizeFoodName(query.criteria.BrandOwner)
+	accept := func(food indexedFood) bool {
+		return (len(dataTypes) == 0 || dataTypes[food.dataType]) && (len(brandOwner) == 0 || food.brandOwner == brandOwner)
+	}
+
+	scores := make(map[int32]float64)
+	matched := make(map[int32]int)
+	for _, term := range terms {
+		// a food counts once per search word, with its best matching word
+		best := make(map[int32]float64)
+		for _, match := range index.expand(term) {
+			postings := index.postings[match.term]
+			idf := math.Log(1 + float64(len(index.foods))/float64(len(postings)))
+			for _, p := range postings {
+				if !accept(index.foods[p.food]) {
+					continue
+				}
+				if score := match.quality * idf * fieldWeight(p.fields); score > best[p.food] {
+					best[p.food] = score
+				}
+			}
+		}
+		for food, score := range best {
+			scores[food] += score
+			matched[food]++
+		}
+	}
+
+	type result struct {
+		food  indexedFood
+		score float64
+	}
+	results := make([]result, 0, len(scores))
+	for position, score := range scores {
+		if query.criteria.RequireAllWords && matched[position] < len(terms) {
+			continue
+		}
+		food := index.foods[position]
+		score *= float64(matched[position]) / float64(len(terms))
+		score /= 1 + 0.1*float64(food.words)
+		if count := query.logged.count(food.fdcID, food.name); count > 0 {
+			score *= 1 + math.Log2(1+float64(count))
+		}
+		results = append(results, result{food: food, score: score})
+	}
+
+	compare := sortFoods(query.criteria.SortBy)
+	descending := query.criteria.SortOrder == "desc"
+	sort.Slice(results, func(i, j int) bool {
+		if order := compare(results[i].food, results[j].food); order != 0 {
+			return (order < 0) != descending
+		}
+		if results[i].score != results[j].score {
+			return results[i].score > results[j].score
+		}
+		return results[i].food.fdcID < results[j].food.fdcID
+	})
+
+	fdcIDs := make([]int, 0, query.criteria.PageSize)
+	for i := (query.criteria.PageNumber - 1) * query.criteria.PageSize; i >= 0 && i < len(results) && len(fdcIDs) < query.criteria.PageSize; i++ {
+		fdcIDs = append(fdcIDs, results[i].food.fdcID)
+	}
+	return fdcIDs, len(results)
+}
+
+// sortFoods returns how to order foods by a FoodSearchCriteria.SortBy field, as a negative number if a comes first,
+// a positive one if b does and zero to order them by how well they match
+func sortFoods(sortBy string) func(a indexedFood, b indexedFood) int {
+	switch sortBy {
+	case fdc.SortByDataType:
+		return func(a indexedFood, b indexedFood) int { return strings.Compare(a.dataType, b.dataType) }
+	case fdc.SortByDescription:
+		return func(a indexedFood, b indexedFood) int { return strings.Compare(a.name, b.name) }
+	case fdc.SortByFdcID:
+		return func(a indexedFood, b indexedFood) int { return a.fdcID - b.fdcID }
+	case fdc.SortByPublished:
+		return func(a indexedFood, b indexedFood) int {
+			switch {
+			case a.published.Before(b.published):
+				return -1
+			case a.published.After(b.published):
+				return 1
+			}
+			return 0
+		}
+	default:
+		return func(indexedFood, indexedFood) int { return 0 }
+	}
+}
+
+// termMatch is a word of the index that matches a search word, and how well
+type termMatch struct {
+	term    int
+	quality float64
+}
+
+// expand returns the words of the index matching a search word exactly, by prefix or with typos
+func (index *foodIndex) expand(word string) []termMatch {
+	var matches []termMatch
+	seen := make(map[int]bool)
+
+	length := utf8.RuneCountInString(word)
+	first := sort.SearchStrings(index.terms, word)
+	for i := first; i < len(index.terms) && strings.HasPrefix(index.terms[i], word); i++ {
+		quality := 1.0
+		if index.terms[i] != word {
+			if length < minPrefixRunes {
+				continue
+			}
+			quality = prefixMatch
+		}
+		matches = append(matches, termMatch{term: i, quality: quality})
+		seen[i] = true
+	}
+
+	if length < minFuzzyRunes {
+		return matches
+	}
+	maxTypos := 1
+	if length >= twoTyposRunes {
+		maxTypos = 2
+	}
+	for candidateLength := length - maxTypos; candidateLength <= length+maxTypos; candidateLength++ {
+		for _, i := range index.byLength[candidateLength] {
+			if seen[i] {
+				continue
+			}
+			typos := editDistance(word, index.terms[i], maxTypos)
+			switch {
+			case typos > maxTypos:
+			case typos == 1:
+				matches = append(matches, termMatch{term: i, quality: oneTypoMatch})
+			case typos == 2:
+				matches = append(matches, termMatch{term: i, quality: twoTyposMatch})
+			}
+		}
+	}
+	return matches
+}
+
+// editDistance returns the number of insertions, deletions, substitutions and transpositions of adjacent letters
+// that turn a into b, or max+1 if it takes more than max
+func editDistance(a string, b string, max int) int {
+	s, t := []rune(a), []rune(b)
+	if diff := len(s) - len(t); diff > max || -diff > max {
+		return max + 1
+	}
+
+	// rows i-2, i-1 and i of the optimal string alignment distance matrix
+	previous2 := make([]int, len(t)+1)
+	previous := make([]int, len(t)+1)
+	current := make([]int, len(t)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		current[0] = i
+		rowMin := current[0]
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(minInt(previous[j]+1, current[j-1]+1), previous[j-1]+cost)
+			if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] {
+				current[j] = minInt(current[j], previous2[j-2]+1)
+			}
+			rowMin = minInt(rowMin, current[j])
+		}
+		if rowMin > max {
+			return max + 1
+		}
+		previous2, previous, current = previous, current, previous2
+	}
+	if previous[len(t)] > max {
+		return max + 1
+	}
+	return previous[len(t)]
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func fieldWeight(fields uint8) float64 {
+	switch {
+	case fields&inDescription != 0:
+		return descriptionWeight
+	case fields&inBrandOwner != 0:
+		return brandOwnerWeight
+	default:
+		return ingredientsWeight
+	}
+}
+
+// searchTerms splits text into lowercase words
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// normalizeFoodName lowercases a food or brand name and collapses its whitespace so that names can be compared
+func normalizeFoodName(name string) string {
+	return strings.Join(strings.Fields(strings.ToLower(name)), " ")
+}
+
+// loggedFoods counts how often a user logged each food, by fdcId and, for foods logged without one, by name
+type loggedFoods struct {
+	byFdcID map[int]int
+	byName  map[string]int
+}
+
+func (l loggedFoods) count(fdcID int, name string) int {
+	return l.byFdcID[fdcID] + l.byName[name]
+}
+
+// recentlyLoggedFoods returns the foods a user logged in the last loggedFoodsDays days
+// it runs on every search, so only the fdcId and name of each food are read
+func recentlyLoggedFoods(ctx context.Context, days DayStore, userID string, now time.Time) (loggedFoods, error) {
+	logged := loggedFoods{byFdcID: make(map[int]int), byName: make(map[string]int)}
+
+	// a day either side since dates are in the user's time zone
+	query := DayQuery{
+		From:      now.AddDate(0, 0, -loggedFoodsDays-1).Format(dateLayout),
+		To:        now.AddDate(0, 0, 1).Format(dateLayout),
+		Page:      1,
+		PageSize:  loggedFoodsDays + 3,
+		FoodsOnly: true,
+	}
+	dayRecords, _, err := days.ListDays(ctx, userID, query)
+	if err != nil {
+		return logged, err
+	}
+
+	for _, dayRecord := range dayRecords {
+		for _, meal := range dayRecord.Meals {
+			for _, food := range meal.Foods {
+				if food.FdcId > 0 {
+					logged.byFdcID[food.FdcId]++
+				} else {
+					logged.byName[normalizeFoodName(food.Name)]++
+				}
+			}
+		}
+	}
+	return logged, nil
+}
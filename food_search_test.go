@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/refactored-spoon-backend/internal/fdc"
+	"github.com/refactored-spoon-backend/internal/lib"
+)
+
+func TestFoodSearch(t *testing.T) {
+	s, _ := newTestServer(t)
+	local := NewLocalFoodSource(importTestDataset(t), s.days)
+	s.foods = local
+	h := s.Handler()
+
+	search := func(criteria fdc.FoodSearchCriteria) *fdc.FoodSearchResult {
+		t.Helper()
+		w := serve(t, h, http.MethodPost, "/food/search", "", criteria, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+		}
+		var result fdc.FoodSearchResult
+		decodeResponse(t, w, &result)
+		return &result
+	}
+
+	// searches fail until the foods are indexed
+	w := serve(t, h, http.MethodPost, "/food/search", "", fdc.FoodSearchCriteria{GeneralSearchInput: "banana"}, nil)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d before indexing, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if err := local.Reindex(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		criteria fdc.FoodSearchCriteria
+		wantIDs  []int
+	}{
+		{name: "typo", criteria: fdc.FoodSearchCriteria{GeneralSearchInput: "bananna"}, wantIDs: []int{2344720}},
+		{name: "transposed letters", criteria: fdc.FoodSearchCriteria{GeneralSearchInput: "chpis"}, wantIDs: []int{2344720, 2344721}},
+		{name: "two typos in a long word", criteria: fdc.FoodSearchCriteria{GeneralSearchInput: "plantians"}, wantIDs: []int{2344721}},
+		{name: "no typos in short words", criteria: fdc.FoodSearchCriteria{GeneralSearchInput: "rav"}, wantIDs: []int{}},
+		{name: "prefix while typing", criteria: fdc.FoodSearchCriteria{GeneralSearchInput: "plan"}, wantIDs: []int{2344721}},
+		{name: "exact match beats prefix", criteria: fdc.FoodSearchCriteria{GeneralSearchInput: "banana"}, wantIDs: []int{2344720, 1105314}},
+		{name: "data type filter", criteria: fdc.FoodSearchCriteria{GeneralSearchInput: "banana", DataType: []string{fdc.DataTypeFoundation}}, wantIDs: []int{1105314}},
+		{name: "brand owner filter ignores case", criteria: fdc.FoodSearchCriteria{GeneralSearchInput: "bananas", BrandOwner: "crunchy  co"}, wantIDs: []int{2344720}},
+		{name: "unknown brand owner", criteria: fdc.FoodSearchCriteria{GeneralSearchInput: "chips", BrandOwner: "Soggy Inc"}, wantIDs: []int{}},
+		{name: "sort by description", criteria: fdc.FoodSearchCriteria{GeneralSearchInput: "bananas chips", SortBy: fdc.SortByDescription}, wantIDs: []int{2344720, 1105314, 2344721}},
+		{name: "sort by data type descending", criteria: fdc.FoodSearchCriteria{GeneralSearchInput: "bananas chips", SortBy: fdc.SortByDataType, SortOrder: "desc"}, wantIDs: []int{1105314, 2344720, 2344721}},
+		{name: "sort by fdcId descending", criteria: fdc.FoodSearchCriteria{GeneralSearchInput: "bananas chips", SortBy: fdc.SortByFdcID, SortOrder: "desc"}, wantIDs: []int{2344721, 2344720, 1105314}},
+		{name: "sort by published date", criteria: fdc.FoodSearchCriteria{GeneralSearchInput: "bananas chips", SortBy: fdc.SortByPublished}, wantIDs: []int{1105314, 2344721, 2344720}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := search(tt.criteria)
+			got := make([]int, 0)
+			for _, food := range result.Foods {
+				got = append(got, food.FdcId)
+			}
+			if !reflect.DeepEqual(got, tt.wantIDs) {
+				t.Errorf("got foods %v, want %v", got, tt.wantIDs)
+			}
+		})
+	}
+
+	t.Run("pagination", func(t *testing.T) {
+		result := search(fdc.FoodSearchCriteria{GeneralSearchInput: "bananas chips", PageNumber: 2, PageSize: 2})
+		if result.TotalHits != 3 || result.CurrentPage != 2 || result.TotalPages != 2 || !reflect.DeepEqual(result.PageList, []int{1, 2}) || len(result.Foods) != 1 {
+			t.Errorf("got search result %+v", result)
+		}
+		if food := result.Foods[0]; food.DataType != fdc.DataTypeBranded || food.PublishedDate != "2021-03-15" {
+			t.Errorf("got food %+v", food)
+		}
+	})
+
+	t.Run("invalid data type", func(t *testing.T) {
+		w := serve(t, h, http.MethodPost, "/food/search", "", fdc.FoodSearchCriteria{GeneralSearchInput: "chips", DataType: []string{"Cheese"}}, nil)
+		var apiErr lib.APIError
+		decodeResponse(t, w, &apiErr)
+		if w.Code != http.StatusUnprocessableEntity || apiErr.Code != lib.CodeValidationFailed {
+			t.Errorf("got status %d with code %q, want %d", w.Code, apiErr.Code, http.StatusUnprocessableEntity)
+		}
+	})
+
+	t.Run("logged foods rank higher", func(t *testing.T) {
+		// Banana chips and Plantain chips match equally well, so the lower fdcId comes first
+		if first := search(fdc.FoodSearchCriteria{GeneralSearchInput: "chips"}).Foods[0].FdcId; first != 2344720 {
+			t.Fatalf("got %d first without logged foods, want 2344720", first)
+		}
+
+		login := signIn(t, s, "plantains@example.com")
+		meal := &Meal{Name: "snack", Foods: []Food{{Name: "Plantain chips", FdcId: 2344721, Serving: 30}}}
+		if err := s.days.InsertMeal(context.Background(), login.UserID, time.Now().Format(dateLayout), meal); err != nil {
+			t.Fatal(err)
+		}
+
+		w := serve(t, h, http.MethodPost, "/food/search", login.AccessToken, fdc.FoodSearchCriteria{GeneralSearchInput: "chips"}, nil)
+		var result fdc.FoodSearchResult
+		decodeResponse(t, w, &result)
+		if len(result.Foods) != 2 || result.Foods[0].FdcId != 2344721 {
+			t.Errorf("got foods %+v for a user who logged plantain chips, want 2344721 first", result.Foods)
+		}
+
+		// foods logged before they had an fdcId are recognized by name
+		other := signIn(t, s, "bananas@example.com")
+		meal = &Meal{Name: "breakfast", Foods: []Food{{Name: "bananas,  RAW", Serving: 120}}}
+		if err := s.days.InsertMeal(context.Background(), other.UserID, time.Now().Format(dateLayout), meal); err != nil {
+			t.Fatal(err)
+		}
+		w = serve(t, h, http.MethodPost, "/food/search", other.AccessToken, fdc.FoodSearchCriteria{GeneralSearchInput: "banana"}, nil)
+		decodeResponse(t, w, &result)
+		if len(result.Foods) != 2 || result.Foods[0].FdcId != 1105314 {
+			t.Errorf("got foods %+v for a user who logged raw bananas, want 1105314 first", result.Foods)
+		}
+
+		// invalid tokens are rejected rather than treated as anonymous
+		w = serve(t, h, http.MethodPost, "/food/search", "not-a-token", fdc.FoodSearchCriteria{GeneralSearchInput: "chips"}, nil)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("got status %d for an invalid token, want %d", w.Code, http.StatusUnauthorized)
+		}
+	})
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		max  int
+		want int
+	}{
+		{"banana", "banana", 1, 0},
+		{"banana", "bananas", 1, 1},
+		{"bananna", "banana", 1, 1},
+		{"chpis", "chips", 1, 1},
+		{"plantians", "plantains", 2, 1},
+		{"kale", "salt", 1, 2},
+		{"kale", "kalamata", 2, 3},
+		{"crème", "creme", 1, 1},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b, tt.max); got != tt.want {
+			t.Errorf("editDistance(%q, %q, %d) = %d, want %d", tt.a, tt.b, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestPageList(t *testing.T) {
+	tests := []struct {
+		current, totalPages int
+		want                []int
+	}{
+		{1, 0, []int{}},
+		{1, 3, []int{1, 2, 3}},
+		{1, 20, []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+		{12, 20, []int{7, 8, 9, 10, 11, 12, 13, 14, 15, 16}},
+		{19, 20, []int{11, 12, 13, 14, 15, 16, 17, 18, 19, 20}},
+	}
+	for _, tt := range tests {
+		if got := pageList(tt.current, tt.totalPages); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("pageList(%d, %d) = %v, want %v", tt.current, tt.totalPages, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/refactored-spoon-backend/internal/lib"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// calories per gram of each macro that can be targeted as a percent of calories
+var macroCaloriesPerGram = map[string]float64{
+	"protein": caloriesPerGramProtein,
+	"carbs":   caloriesPerGramCarbs,
+	"fat":     caloriesPerGramFat,
+}
+
+// units that goals of each nutrient are expressed in, matching the USDA unit names
+var nutrientUnits = map[string]string{
+	"calories":    "KCAL",
+	"protein":     "G",
+	"carbs":       "G",
+	"fat":         "G",
+	"sugar":       "G",
+	"fiber":       "G",
+	"sodium":      "MG",
+	"calcium":     "MG",
+	"iron":        "MG",
+	"cholesterol": "MG",
+	"potassium":   "MG",
+	"vitaminA":    "UG",
+	"vitaminC":    "MG",
+}
+
+// NutritionGoal is the daily target of a single nutrient, either an absolute amount or a percent of the calorie target
+type NutritionGoal struct {
+	Value             float64 `json:"value,omitempty" bson:"value,omitempty"`                         // in the unit of the nutrient
+	PercentOfCalories float64 `json:"percentOfCalories,omitempty" bson:"percentOfCalories,omitempty"` // protein, carbs and fat only
+}
+
+// NutritionGoals are the goals of a user keyed by NutritionSummary field name, e.g. "calories" or "vitaminC"
+type NutritionGoals map[string]NutritionGoal
+
+// NutrientProgress compares the consumed amount of a nutrient against its target
+type NutrientProgress struct {
+	UnitName  string  `json:"unitName"`
+	Target    float64 `json:"target"`
+	Consumed  float64 `json:"consumed"`
+	Remaining float64 `json:"remaining"` // negative once the target is exceeded
+	Percent   float64 `json:"percent"`   // consumed as a percent of target
+	Over      bool    `json:"over"`
+	Under     bool    `json:"under"`
+}
+
+// goalsResponse is the body of GET and PUT /users/me/goals
+type goalsResponse struct {
+	Goals   NutritionGoals     `json:"goals"`
+	Targets map[string]float64 `json:"targets"` // absolute targets after applying profile defaults and percent goals
+}
+
+// GoalsHandler handles /users/me/goals GET and PUT requests
+func (s *server) GoalsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(lib.UserIDFromContext(r.Context()))
+	if err != nil {
+		lib.WriteError(w, r, http.StatusUnauthorized, lib.CodeUnauthorized, "invalid user ID in token", nil)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		getGoals(w, r, s.users, userID)
+	case http.MethodPut:
+		updateGoals(w, r, s.users, userID)
+	}
+}
+
+func getGoals(w http.ResponseWriter, r *http.Request, users UserStore, userID primitive.ObjectID) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	profile, goals, err := getProfileAndGoals(ctx, users, userID)
+	if err != nil {
+		lib.WriteInternalError(w, r, "could not find goals", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(goalsResponse{Goals: goals, Targets: dailyTargets(profile, goals)})
+}
+
+func updateGoals(w http.ResponseWriter, r *http.Request, users UserStore, userID primitive.ObjectID) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	decoder := json.NewDecoder(r.Body)
+	var goals NutritionGoals
+	err := decoder.Decode(&goals)
+	if err != nil {
+		lib.WriteDecodeError(w, r, "could not decode goals request", err)
+		return
+	}
+
+	if err := validateGoals(goals); err != nil {
+		lib.WriteValidationError(w, r, err)
+		return
+	}
+
+	err = users.SetGoals(ctx, userID, goals)
+	if err == errUserNotFound {
+		lib.WriteError(w, r, http.StatusNotFound, lib.CodeNotFound, err.Error(), nil)
+		return
+	}
+	if err != nil {
+		lib.WriteInternalError(w, r, "unable to update goals", err)
+		return
+	}
+
+	profile, err := GetProfile(ctx, users, userID)
+	if err != nil {
+		lib.WriteInternalError(w, r, "could not find profile", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(goalsResponse{Goals: goals, Targets: dailyTargets(profile, goals)})
+}
+
+// GetDailyTargets returns the absolute daily targets of a user keyed by NutritionSummary field name
+func GetDailyTargets(ctx context.Context, users UserStore, userID string) (map[string]float64, error) {
+	userObjectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	profile, goals, err := getProfileAndGoals(ctx, users, userObjectID)
+	if err != nil {
+		return nil, err
+	}
+	return dailyTargets(profile, goals), nil
+}
+
+func getProfileAndGoals(ctx context.Context, users UserStore, userID primitive.ObjectID) (*Profile, NutritionGoals, error) {
+	user, err := users.GetUser(ctx, userID)
+	if err == errUserNotFound {
+		return &Profile{}, NutritionGoals{}, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if user.Goals == nil {
+		user.Goals = NutritionGoals{}
+	}
+	return &user.Profile, user.Goals, nil
+}
+
+// dailyTargets starts from the targets derived from the profile and overrides them with the user's own goals
+// percent of calories goals are converted to grams, and skipped if there is no calorie target to base them on
+func dailyTargets(profile *Profile, goals NutritionGoals) map[string]float64 {
+	targets := make(map[string]float64)
+	if defaults, err := ComputeTargets(profile, time.Now()); err == nil {
+		for name, nutrient := range defaults.Nutrition.fields() {
+			if nutrient.Value > 0 {
+				targets[name] = nutrient.Value
+			}
+		}
+	}
+
+	for name, goal := range goals {
+		if goal.PercentOfCalories == 0 {
+			targets[name] = goal.Value
+		}
+	}
+
+	calories, ok := targets["calories"]
+	for name, goal := range goals {
+		if goal.PercentOfCalories > 0 && ok {
+			targets[name] = math.Round(calories * goal.PercentOfCalories / 100 / macroCaloriesPerGram[name])
+		}
+	}
+
+	return targets
+}
+
+// computeProgress compares consumed nutrition against every nutrient that has a target
+func computeProgress(targets map[string]float64, consumed NutritionSummary) map[string]NutrientProgress {
+	consumedFields := consumed.fields()
+	progress := make(map[string]NutrientProgress, len(targets))
+	for name, target := range targets {
+		value := consumedFields[name].Value
+		p := NutrientProgress{
+			UnitName:  nutrientUnits[name],
+			Target:    target,
+			Consumed:  value,
+			Remaining: target - value,
+			Over:      value > target,
+			Under:     value < target,
+		}
+		if target > 0 {
+			p.Percent = math.Round(value/target*1000) / 10
+		}
+		progress[name] = p
+	}
+	return progress
+}
+
+// validateGoals returns lib.ValidationErrors for the goals of unknown nutrients and invalid goals, by nutrient name
+// lib.Validate does not handle maps so the checks are spelled out here
+func validateGoals(goals NutritionGoals) error {
+	names := make([]string, 0, len(goals))
+	for name := range goals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs lib.ValidationErrors
+	totalPercent := 0.0
+	for _, name := range names {
+		goal := goals[name]
+		if _, ok := nutrientUnits[name]; !ok {
+			errs = append(errs, lib.FieldError{Field: name, Message: "is not a known nutrient"})
+			continue
+		}
+		// a goal without either would be a target of 0 that any intake is over
+		if goal.Value == 0 && goal.PercentOfCalories == 0 {
+			errs = append(errs, lib.FieldError{Field: name, Message: "must have a value or a percent of calories"})
+			continue
+		}
+		if goal.Value < 0 {
+			errs = append(errs, lib.FieldError{Field: name + ".value", Message: "must be at least 0"})
+		}
+		if goal.PercentOfCalories < 0 {
+			errs = append(errs, lib.FieldError{Field: name + ".percentOfCalories", Message: "must be at least 0"})
+		}
+		if goal.PercentOfCalories > 0 {
+			if _, ok := macroCaloriesPerGram[name]; !ok {
+				errs = append(errs, lib.FieldError{Field: name + ".percentOfCalories", Message: "is only allowed for protein, carbs and fat"})
+				continue
+			}
+			if goal.Value > 0 {
+				errs = append(errs, lib.FieldError{Field: name, Message: "must be either a value or a percent of calories, not both"})
+			}
+			totalPercent += goal.PercentOfCalories
+		}
+	}
+	if totalPercent > 100 {
+		errs = append(errs, lib.FieldError{Field: "percentOfCalories", Message: "must not add up to more than 100"})
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
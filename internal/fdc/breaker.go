@@ -0,0 +1,96 @@
+package fdc
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CircuitOpenError is returned without contacting FoodData Central while the circuit breaker considers it down
+type CircuitOpenError struct {
+	RetryAfter time.Duration // until the breaker lets a trial request through
+}
+
+func (e *CircuitOpenError) Error() string {
+	return "fdc: FoodData Central is failing, not sending requests for " + strconv.Itoa(int(e.RetryAfter.Seconds())) + "s"
+}
+
+// Breaker is a circuit breaker that stops requests to FoodData Central after consecutive failures
+// so that users get an answer straight away instead of waiting on timeouts and retries, it is safe for concurrent use
+//
+// the circuit opens after Threshold consecutive failures and stays open for Cooldown,
+// after which a single trial request is let through, closing the circuit if it succeeds and reopening it otherwise
+type Breaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool // a trial request is in flight
+	now       func() time.Time
+}
+
+// NewBreaker returns a closed circuit breaker
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{Threshold: threshold, Cooldown: cooldown, now: time.Now}
+}
+
+// Allow reports whether a request may be sent, and if not how long until the next trial request
+// every allowed request must be followed by a call to Success, Failure or Cancel
+func (b *Breaker) Allow() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.Threshold {
+		return 0, true
+	}
+
+	now := b.now()
+	if now.Before(b.openUntil) {
+		return b.openUntil.Sub(now), false
+	}
+	if b.trial {
+		// wait for the trial request to settle the state
+		return b.Cooldown, false
+	}
+	b.trial = true
+	return 0, true
+}
+
+// Success closes the circuit
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.trial = false
+}
+
+// Failure counts a failed request, opening the circuit once there are Threshold failures in a row
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.trial = false
+	if b.failures >= b.Threshold {
+		b.openUntil = b.now().Add(b.Cooldown)
+	}
+}
+
+// Cancel gives up on an allowed request without judging FoodData Central, e.g. when the caller went away
+func (b *Breaker) Cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+}
+
+// Open reports whether requests are currently being rejected
+func (b *Breaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.failures >= b.Threshold && b.now().Before(b.openUntil)
+}
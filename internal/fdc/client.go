@@ -0,0 +1,351 @@
+// Package fdc is a client for the USDA FoodData Central API
+// https://fdc.nal.usda.gov/api-guide.html
+package fdc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultBaseURL is the FoodData Central API that NewClientFromEnv uses when USDA_API_URL is not set
+	DefaultBaseURL = "https://api.nal.usda.gov/fdc/v1/"
+	// DefaultTimeout bounds a single attempt at a request including reading the response body
+	DefaultTimeout = 5 * time.Second
+
+	// defaults for retrying failed requests, the wait before retry n is a random duration
+	// between half of and all of RetryWait * 2^n, capped at MaxRetryWait
+	DefaultRetries      = 2
+	DefaultRetryWait    = 250 * time.Millisecond
+	DefaultMaxRetryWait = 2 * time.Second
+
+	// defaults for the circuit breaker
+	DefaultBreakerThreshold = 5
+	DefaultBreakerCooldown  = 30 * time.Second
+
+	// apiKeyHeader keeps the API key out of URLs, which end up in logs and error messages
+	apiKeyHeader = "X-Api-Key"
+
+	// maxErrorBodyBytes is how much of an error response is kept in a StatusError
+	maxErrorBodyBytes = 512
+)
+
+// StatusError is returned when FoodData Central responds with anything but 200 OK
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Body       string        // start of the response body, USDA sometimes explains the error in it
+	RetryAfter time.Duration // from the Retry-After header of 429 and 503 responses, 0 if absent
+}
+
+func (e *StatusError) Error() string {
+	if len(e.Body) == 0 {
+		return "fdc: unexpected response " + e.Status
+	}
+	return "fdc: unexpected response " + e.Status + ": " + e.Body
+}
+
+// IsNotFound reports whether err is a 404 response from FoodData Central, i.e. an unknown fdcId
+func IsNotFound(err error) bool {
+	var statusErr *StatusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound
+}
+
+// Unavailable reports whether err means FoodData Central is down or rate limiting us rather than misbehaving,
+// and how long to wait before trying again if it said so
+func Unavailable(err error) (retryAfter time.Duration, unavailable bool) {
+	var openErr *CircuitOpenError
+	if errors.As(err, &openErr) {
+		return openErr.RetryAfter, true
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && (statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode == http.StatusServiceUnavailable) {
+		return statusErr.RetryAfter, true
+	}
+	return 0, false
+}
+
+// Client sends requests to FoodData Central, it is safe for concurrent use
+// requests that fail because of the network, rate limiting or a 5xx response are retried,
+// and the circuit breaker, if any, rejects requests while FoodData Central keeps failing
+type Client struct {
+	BaseURL    string // ends in a slash
+	APIKey     string
+	HTTPClient *http.Client
+
+	Retries      int
+	RetryWait    time.Duration
+	MaxRetryWait time.Duration // a longer Retry-After from USDA is not waited for
+	Breaker      *Breaker
+}
+
+// NewClient returns a client for the FoodData Central API at baseURL whose request attempts give up after timeout,
+// with the default retries and circuit breaker
+func NewClient(baseURL string, apiKey string, timeout time.Duration) *Client {
+	return &Client{
+		BaseURL:      strings.TrimSuffix(baseURL, "/") + "/",
+		APIKey:       apiKey,
+		HTTPClient:   &http.Client{Timeout: timeout},
+		Retries:      DefaultRetries,
+		RetryWait:    DefaultRetryWait,
+		MaxRetryWait: DefaultMaxRetryWait,
+		Breaker:      NewBreaker(DefaultBreakerThreshold, DefaultBreakerCooldown),
+	}
+}
+
+// NewClientFromEnv returns a client configured from the environment
+//
+//	USDA_API_KEY   api.data.gov key sent with every request
+//	USDA_API_URL   base URL to point at a mirror or a fake server, default https://api.nal.usda.gov/fdc/v1/
+//	USDA_TIMEOUT   per attempt, e.g. 5s, default 5s
+//	USDA_RETRIES   retries of failed requests, default 2
+func NewClientFromEnv() (*Client, error) {
+	baseURL := os.Getenv("USDA_API_URL")
+	if len(baseURL) == 0 {
+		baseURL = DefaultBaseURL
+	}
+
+	timeout := DefaultTimeout
+	if value := os.Getenv("USDA_TIMEOUT"); len(value) > 0 {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, errors.New("USDA_TIMEOUT must be a positive duration such as 5s: " + value)
+		}
+		timeout = parsed
+	}
+
+	client := NewClient(baseURL, os.Getenv("USDA_API_KEY"), timeout)
+	if value := os.Getenv("USDA_RETRIES"); len(value) > 0 {
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 0 {
+			return nil, errors.New("USDA_RETRIES must be a non-negative integer: " + value)
+		}
+		client.Retries = retries
+	}
+	return client, nil
+}
+
+// Search returns a page of the foods matching the search criteria, with abridged nutrients
+func (c *Client) Search(ctx context.Context, criteria FoodSearchCriteria) (*FoodSearchResult, error) {
+	body, err := json.Marshal(criteria)
+	if err != nil {
+		return nil, err
+	}
+
+	var result FoodSearchResult
+	err = c.do(ctx, http.MethodPost, "foods/search", nil, body, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Food returns the details of the food with the given FoodData Central ID
+func (c *Client) Food(ctx context.Context, fdcID int) (*FoodDetailResult, error) {
+	var result FoodDetailResult
+	err := c.do(ctx, http.MethodGet, "food/"+strconv.Itoa(fdcID), nil, nil, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Foods returns the details of the foods with the given FoodData Central IDs, leaving out unknown IDs
+func (c *Client) Foods(ctx context.Context, fdcIDs []int) ([]FoodDetailResult, error) {
+	ids := make([]string, len(fdcIDs))
+	for i, fdcID := range fdcIDs {
+		ids[i] = strconv.Itoa(fdcID)
+	}
+
+	var result []FoodDetailResult
+	err := c.do(ctx, http.MethodGet, "foods", url.Values{"fdcIds": {strings.Join(ids, ",")}}, nil, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// do sends a request to the endpoint at path and decodes the JSON response into result, retrying failed attempts
+// the circuit breaker, if any, judges the request as a whole once its retries are done rather than every attempt
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, body []byte, result interface{}) error {
+	endpoint := c.BaseURL + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+
+	if c.Breaker != nil {
+		if retryAfter, ok := c.Breaker.Allow(); !ok {
+			return &CircuitOpenError{RetryAfter: retryAfter}
+		}
+	}
+
+	err := c.retry(ctx, method, endpoint, body, result)
+
+	if c.Breaker != nil {
+		switch {
+		case ctx.Err() != nil:
+			c.Breaker.Cancel()
+		case failed(err):
+			c.Breaker.Failure()
+		default:
+			c.Breaker.Success()
+		}
+	}
+	return err
+}
+
+// retry sends a request until it succeeds, fails in a way retrying would not help, or runs out of retries
+func (c *Client) retry(ctx context.Context, method string, endpoint string, body []byte, result interface{}) error {
+	for attempt := 0; ; attempt++ {
+		err := c.send(ctx, method, endpoint, body, result)
+		if err == nil || attempt >= c.Retries || !retryable(ctx, err) {
+			return err
+		}
+
+		wait, ok := c.retryWait(attempt, err)
+		if deadline, hasDeadline := ctx.Deadline(); !ok || (hasDeadline && time.Until(deadline) < wait) {
+			return err
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, method string, endpoint string, body []byte, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if len(c.APIKey) > 0 {
+		req.Header.Set(apiKeyHeader, c.APIKey)
+	}
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		start, _ := ioutil.ReadAll(io.LimitReader(res.Body, maxErrorBodyBytes))
+		return &StatusError{
+			StatusCode: res.StatusCode,
+			Status:     res.Status,
+			Body:       strings.TrimSpace(string(start)),
+			RetryAfter: parseRetryAfter(res.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+		return &DecodeError{Err: err}
+	}
+	return nil
+}
+
+// DecodeError is returned when a 200 OK response from FoodData Central is not the expected JSON
+type DecodeError struct {
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return "fdc: unable to decode response: " + e.Err.Error()
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// failed reports whether err counts against FoodData Central for the circuit breaker:
+// network errors, rate limiting and 5xx responses
+// unknown foods and malformed responses do not, since retrying would not help
+func failed(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500
+	}
+
+	var decodeErr *DecodeError
+	return !errors.As(err, &decodeErr)
+}
+
+// retryable reports whether an attempt that failed with err may succeed if sent again
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var openErr *CircuitOpenError
+	if errors.As(err, &openErr) {
+		return false
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotImplemented {
+		return false
+	}
+	return failed(err)
+}
+
+// retryWait returns how long to wait before retrying after the given attempt,
+// or false if FoodData Central asked us to wait longer than MaxRetryWait
+func (c *Client) retryWait(attempt int, err error) (time.Duration, bool) {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+		return statusErr.RetryAfter, statusErr.RetryAfter <= c.MaxRetryWait
+	}
+
+	// full backoff would make every client retry in lockstep, so pick a random point in its upper half
+	backoff := c.RetryWait << uint(attempt)
+	if backoff > c.MaxRetryWait || backoff <= 0 {
+		backoff = c.MaxRetryWait
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)), true
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or as an HTTP date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if len(value) == 0 {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
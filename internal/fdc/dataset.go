@@ -0,0 +1,252 @@
+package fdc
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// data types of the foods in the FoodData Central downloads that users can log
+// https://fdc.nal.usda.gov/download-datasets.html
+const (
+	DataTypeFoundation = "Foundation"
+	DataTypeSRLegacy   = "SR Legacy"
+	DataTypeBranded    = "Branded"
+	DataTypeSurvey     = "Survey (FNDDS)"
+)
+
+// csvDataTypes maps the data_type column of food.csv onto the dataType of the JSON downloads and the API
+// the other data types are the samples and acquisitions that Foundation foods are derived from
+var csvDataTypes = map[string]string{
+	"foundation_food":   DataTypeFoundation,
+	"sr_legacy_food":    DataTypeSRLegacy,
+	"branded_food":      DataTypeBranded,
+	"survey_fndds_food": DataTypeSurvey,
+}
+
+// ReadJSONDataset calls fn with each food of a FoodData Central JSON download
+// the download is an object with a single array of foods, e.g. { "FoundationFoods": [...] },
+// which is streamed since the branded foods download is several gigabytes
+func ReadJSONDataset(r io.Reader, fn func(FoodDetailResult) error) error {
+	decoder := json.NewDecoder(r)
+	if err := expectDelim(decoder, '{'); err != nil {
+		return err
+	}
+
+	for decoder.More() {
+		// the name of the array depends on the download
+		if _, err := decoder.Token(); err != nil {
+			return err
+		}
+		if err := expectDelim(decoder, '['); err != nil {
+			return err
+		}
+
+		for decoder.More() {
+			var food FoodDetailResult
+			if err := decoder.Decode(&food); err != nil {
+				return err
+			}
+			if err := fn(food); err != nil {
+				return err
+			}
+		}
+
+		if err := expectDelim(decoder, ']'); err != nil {
+			return err
+		}
+	}
+	return expectDelim(decoder, '}')
+}
+
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return errors.New("fdc: malformed dataset, expected " + delim.String())
+	}
+	return nil
+}
+
+// ReadCSVDataset calls fn with each food of an extracted FoodData Central CSV download in dir
+// food.csv, nutrient.csv and food_nutrient.csv are required, branded_food.csv adds the brand owner,
+// ingredients and serving size of branded foods
+// the nutrients of every food are held in memory while reading, the JSON downloads need far less
+func ReadCSVDataset(dir string, fn func(FoodDetailResult) error) error {
+	nutrients := make(map[int]USDANutrient)
+	err := readCSV(filepath.Join(dir, "nutrient.csv"), func(row csvRow) error {
+		id, err := row.int("id")
+		if err != nil {
+			return err
+		}
+		rank, _ := row.int("rank")
+		nutrients[id] = USDANutrient{
+			Id:       id,
+			Number:   row.get("nutrient_nbr"),
+			Name:     row.get("name"),
+			Rank:     rank,
+			UnitName: row.get("unit_name"),
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	foodNutrients := make(map[int][]FoodNutrient)
+	err = readCSV(filepath.Join(dir, "food_nutrient.csv"), func(row csvRow) error {
+		id, err := row.int("id")
+		if err != nil {
+			return err
+		}
+		fdcID, err := row.int("fdc_id")
+		if err != nil {
+			return err
+		}
+		nutrientID, err := row.int("nutrient_id")
+		if err != nil {
+			return err
+		}
+		amount, err := row.float("amount")
+		if err != nil {
+			return err
+		}
+		nutrient, ok := nutrients[nutrientID]
+		if !ok {
+			nutrient = USDANutrient{Id: nutrientID}
+		}
+		foodNutrients[fdcID] = append(foodNutrients[fdcID], FoodNutrient{Type: "FoodNutrient", Id: id, Nutrient: nutrient, Amount: amount})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	branded := make(map[int]FoodDetailResult)
+	err = readCSV(filepath.Join(dir, "branded_food.csv"), func(row csvRow) error {
+		fdcID, err := row.int("fdc_id")
+		if err != nil {
+			return err
+		}
+		servingSize, _ := row.float("serving_size")
+		branded[fdcID] = FoodDetailResult{
+			BrandOwner:      row.get("brand_owner"),
+			GtinUpc:         row.get("gtin_upc"),
+			Ingredients:     row.get("ingredients"),
+			ServingSize:     servingSize,
+			ServingSizeUnit: row.get("serving_size_unit"),
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return readCSV(filepath.Join(dir, "food.csv"), func(row csvRow) error {
+		dataType, ok := csvDataTypes[row.get("data_type")]
+		if !ok {
+			return nil
+		}
+		fdcID, err := row.int("fdc_id")
+		if err != nil {
+			return err
+		}
+
+		food := branded[fdcID]
+		food.FdcId = fdcID
+		food.DataType = dataType
+		food.Description = row.get("description")
+		if published, err := time.Parse(publishedDateLayout, row.get("publication_date")); err == nil {
+			food.PublicationDate = published.Format(publicationDateLayout)
+		}
+		food.FoodNutrients = foodNutrients[fdcID]
+		return fn(food)
+	})
+}
+
+// csvRow is a record of a CSV file whose columns are named by its header
+type csvRow struct {
+	path    string
+	number  int // of the record, counting the header
+	columns map[string]int
+	values  []string
+}
+
+func (r csvRow) get(column string) string {
+	i, ok := r.columns[column]
+	if !ok || i >= len(r.values) {
+		return ""
+	}
+	return strings.TrimSpace(r.values[i])
+}
+
+func (r csvRow) int(column string) (int, error) {
+	value, err := strconv.Atoi(r.get(column))
+	if err != nil {
+		return 0, r.invalid(column)
+	}
+	return value, nil
+}
+
+func (r csvRow) float(column string) (float64, error) {
+	value, err := strconv.ParseFloat(r.get(column), 64)
+	if err != nil {
+		return 0, r.invalid(column)
+	}
+	return value, nil
+}
+
+func (r csvRow) invalid(column string) error {
+	return errors.New("fdc: " + filepath.Base(r.path) + " record " + strconv.Itoa(r.number) + ": invalid " + column + " " + strconv.Quote(r.get(column)))
+}
+
+// readCSV calls fn with each record of the CSV file at path after its header
+func readCSV(path string, fn func(csvRow) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// the USDA files start with a byte order mark
+	buffered := bufio.NewReader(file)
+	if bom, err := buffered.Peek(3); err == nil && string(bom) == "\ufeff" {
+		buffered.Discard(3)
+	}
+
+	reader := csv.NewReader(buffered)
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if err != nil {
+		return errors.New("fdc: " + filepath.Base(path) + " has no header: " + err.Error())
+	}
+
+	row := csvRow{path: path, number: 1, columns: make(map[string]int, len(header))}
+	for i, column := range header {
+		row.columns[column] = i
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		row.number++
+		row.values = record
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package fdc
+
+import "time"
+
+// FoodData Central formats dates differently in search results and food details
+const (
+	publishedDateLayout   = "2006-01-02"
+	publicationDateLayout = "1/2/2006"
+)
+
+// FoodSearchCriteria is the body for the FoodData Central POST /foods/search request
+type FoodSearchCriteria struct {
+	GeneralSearchInput string   `json:"generalSearchInput,omitempty" validate:"required,max=200"`
+	PageNumber         int      `json:"pageNumber,omitempty" validate:"min=1"`
+	PageSize           int      `json:"pageSize,omitempty" validate:"min=1,max=200"` // USDA returns at most 200 foods per page
+	RequireAllWords    bool     `json:"requireAllWords,omitempty"`
+	DataType           []string `json:"dataType,omitempty" validate:"max=4,dive,oneof=Foundation|SR Legacy|Branded|Survey (FNDDS)"`
+	BrandOwner         string   `json:"brandOwner,omitempty" validate:"max=200"` // only branded foods have one
+	SortBy             string   `json:"sortBy,omitempty" validate:"oneof=dataType.keyword lowercaseDescription.keyword fdcId publishedDate"`
+	SortOrder          string   `json:"sortOrder,omitempty" validate:"oneof=asc desc"` // only used with SortBy
+}
+
+// values of FoodSearchCriteria.SortBy, without one foods are sorted by how well they match
+const (
+	SortByDataType    = "dataType.keyword"
+	SortByDescription = "lowercaseDescription.keyword"
+	SortByFdcID       = "fdcId"
+	SortByPublished   = "publishedDate"
+)
+
+// UsdaFood is the food result in the FoodData Central POST /foods/search response
+type UsdaFood struct {
+	FdcId           int                    `json:"fdcId,omitempty"`
+	DataType        string                 `json:"dataType,omitempty"`
+	Description     string                 `json:"description,omitempty"`
+	BrandOwner      string                 `json:"brandOwner,omitempty"`
+	GtinUpc         string                 `json:"gtinUpc,omitempty"`
+	Ingredients     string                 `json:"ingredients,omitempty"`
+	ServingSize     float64                `json:"servingSize,omitempty"`
+	ServingSizeUnit string                 `json:"servingSizeUnit,omitempty"`
+	PublishedDate   string                 `json:"publishedDate,omitempty"` // YYYY-MM-DD
+	FoodNutrients   []AbridgedFoodNutrient `json:"foodNutrients,omitempty"`
+}
+
+// AbridgedFoodNutrient is the nutrient result in the FoodData Central POST /foods/search response
+// note that this contains much less information than FoodNutrient, which is what the food detail responses contain
+type AbridgedFoodNutrient struct {
+	NutrientId   int     `json:"nutrientId,omitempty"`
+	NutrientName string  `json:"nutrientName,omitempty"`
+	UnitName     string  `json:"unitName,omitempty"`
+	Value        float64 `json:"value,omitempty"`
+}
+
+// FoodSearchResult is the body of the FoodData Central POST /foods/search response
+type FoodSearchResult struct {
+	FoodSearchCriteria FoodSearchCriteria `json:"foodSearchCriteria,omitempty"`
+	TotalHits          int                `json:"totalHits"` // foods matching across all pages
+	CurrentPage        int                `json:"currentPage,omitempty"`
+	TotalPages         int                `json:"totalPages,omitempty"`
+	PageList           []int              `json:"pageList,omitempty"` // page numbers around the current page to link to
+	Foods              []UsdaFood         `json:"foods,omitempty"`
+}
+
+// FoodDetailResult is the body of the FoodData Central GET /food/{fdcId} response
+// and an element of the GET /foods response
+type FoodDetailResult struct {
+	FdcId           int            `json:"fdcId,omitempty"`
+	DataType        string         `json:"dataType,omitempty"`
+	FoodClass       string         `json:"foodClass,omitempty"`
+	Description     string         `json:"description,omitempty"`
+	BrandOwner      string         `json:"brandOwner,omitempty"` // branded foods only
+	GtinUpc         string         `json:"gtinUpc,omitempty"`    // branded foods only
+	Ingredients     string         `json:"ingredients,omitempty"`
+	ServingSize     float64        `json:"servingSize,omitempty"`
+	ServingSizeUnit string         `json:"servingSizeUnit,omitempty"`
+	PublicationDate string         `json:"publicationDate,omitempty"` // M/D/YYYY, unlike the publishedDate of search results
+	FoodNutrients   []FoodNutrient `json:"foodNutrients,omitempty"`
+}
+
+// Abridged returns the food as FoodData Central returns it in search results
+func (f FoodDetailResult) Abridged() UsdaFood {
+	food := UsdaFood{
+		FdcId:           f.FdcId,
+		DataType:        f.DataType,
+		Description:     f.Description,
+		BrandOwner:      f.BrandOwner,
+		GtinUpc:         f.GtinUpc,
+		Ingredients:     f.Ingredients,
+		ServingSize:     f.ServingSize,
+		ServingSizeUnit: f.ServingSizeUnit,
+	}
+	if published, ok := f.Published(); ok {
+		food.PublishedDate = published.Format(publishedDateLayout)
+	}
+	for _, nutrient := range f.FoodNutrients {
+		food.FoodNutrients = append(food.FoodNutrients, AbridgedFoodNutrient{
+			NutrientId:   nutrient.Nutrient.Id,
+			NutrientName: nutrient.Nutrient.Name,
+			UnitName:     nutrient.Nutrient.UnitName,
+			Value:        nutrient.Amount,
+		})
+	}
+	return food
+}
+
+// Published returns the publication date of the food, if it has a valid one
+func (f FoodDetailResult) Published() (time.Time, bool) {
+	published, err := time.Parse(publicationDateLayout, f.PublicationDate)
+	return published, err == nil
+}
+
+// FoodNutrient is the nutrient result in the FoodData Central food detail responses
+// note that this contains more information than the AbridgedFoodNutrient returned by search
+type FoodNutrient struct {
+	Type     string       `json:"type,omitempty"`
+	Id       int          `json:"id,omitempty"`
+	Nutrient USDANutrient `json:"nutrient,omitempty"`
+	Amount   float64      `json:"amount,omitempty"`
+}
+
+// USDANutrient is the USDA-specific nutrient result in the FoodData Central food detail responses
+type USDANutrient struct {
+	Id       int    `json:"id,omitempty"`
+	Number   string `json:"number,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Rank     int    `json:"rank,omitempty"`
+	UnitName string `json:"unitName,omitempty"`
+}
@@ -0,0 +1,98 @@
+package lib
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ErrSessionInactive is returned by a SessionCheck when the session has been revoked or has expired
+var ErrSessionInactive = errors.New("session has been revoked or has expired")
+
+type contextKey string
+
+const (
+	userIDContextKey    contextKey = "userId"
+	sessionIDContextKey contextKey = "sessionId"
+)
+
+// SessionCheck returns an error if the session an access token belongs to is no longer active
+type SessionCheck func(ctx context.Context, claims *TokenClaims) error
+
+// AuthMiddleware returns a middleware that rejects requests without a valid access token for an active session
+// and stores the caller's user ID and session ID in the request context
+func AuthMiddleware(checkSession SessionCheck) func(http.Handler) http.Handler {
+	return authMiddleware(checkSession, true)
+}
+
+// OptionalAuthMiddleware is AuthMiddleware for routes that also serve anonymous requests,
+// requests without an Authorization header are passed on without a user ID while invalid tokens are still rejected
+func OptionalAuthMiddleware(checkSession SessionCheck) func(http.Handler) http.Handler {
+	return authMiddleware(checkSession, false)
+}
+
+func authMiddleware(checkSession SessionCheck, required bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authorization := r.Header.Get("Authorization")
+			if !required && len(authorization) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !strings.HasPrefix(authorization, "Bearer ") {
+				WriteError(w, r, http.StatusUnauthorized, CodeUnauthorized, "missing bearer token", nil)
+				return
+			}
+
+			claims, err := ParseToken(strings.TrimPrefix(authorization, "Bearer "), AccessToken)
+			if err != nil {
+				WriteError(w, r, http.StatusUnauthorized, CodeUnauthorized, err.Error(), nil)
+				return
+			}
+
+			err = checkSession(r.Context(), claims)
+			if err == ErrSessionInactive || err == ErrInvalidToken {
+				WriteError(w, r, http.StatusUnauthorized, CodeUnauthorized, err.Error(), nil)
+				return
+			}
+			if err != nil {
+				WriteInternalError(w, r, "unable to check session", err)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), userIDContextKey, claims.Subject)
+			ctx = context.WithValue(ctx, sessionIDContextKey, claims.SessionID)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// UserIDFromContext returns the authenticated user ID stored by AuthMiddleware
+func UserIDFromContext(ctx context.Context) string {
+	userID, _ := ctx.Value(userIDContextKey).(string)
+	return userID
+}
+
+// SessionIDFromContext returns the authenticated session ID stored by AuthMiddleware
+func SessionIDFromContext(ctx context.Context) string {
+	sessionID, _ := ctx.Value(sessionIDContextKey).(string)
+	return sessionID
+}
+
+// AdminMiddleware returns a middleware that only lets through requests with an X-Admin-Key header matching apiKey
+// every request is rejected when apiKey is empty, which disables admin endpoints entirely
+func AdminMiddleware(apiKey string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get("X-Admin-Key")
+			if len(apiKey) == 0 || subtle.ConstantTimeCompare([]byte(key), []byte(apiKey)) != 1 {
+				WriteError(w, r, http.StatusForbidden, CodeForbidden, "admin access denied", nil)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
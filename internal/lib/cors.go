@@ -8,7 +8,8 @@ func CorsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, If-Match, Cache-Control")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag, X-Request-ID, X-Cache, Retry-After")
 
 		if r.Method == http.MethodOptions {
 			return
@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// error codes of APIError, one per kind of failure a client may want to handle
+const (
+	CodeBadRequest         = "bad_request"
+	CodeInvalidJSON        = "invalid_json"
+	CodeBodyTooLarge       = "body_too_large"
+	CodeUnauthorized       = "unauthorized"
+	CodeForbidden          = "forbidden"
+	CodeNotFound           = "not_found"
+	CodeMethodNotAllowed   = "method_not_allowed"
+	CodeConflict           = "conflict"
+	CodePreconditionFailed = "precondition_failed"
+	CodeValidationFailed   = "validation_failed"
+	CodeInternal           = "internal"
+	CodeBadGateway         = "bad_gateway"
+	CodeUnavailable        = "service_unavailable"
+)
+
+const requestIDContextKey contextKey = "requestId"
+
+// APIError is the JSON body of every error response
+type APIError struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"requestId,omitempty"`
+}
+
+// WriteError writes an APIError with the given status
+func WriteError(w http.ResponseWriter, r *http.Request, status int, code string, message string, details interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(APIError{
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		RequestID: RequestIDFromContext(r.Context()),
+	})
+}
+
+// WriteInternalError logs err and writes a 500 APIError that does not leak the underlying error to the client
+func WriteInternalError(w http.ResponseWriter, r *http.Request, message string, err error) {
+	log.Printf("[%s] %s: %s\n", RequestIDFromContext(r.Context()), message, err.Error())
+	WriteError(w, r, http.StatusInternalServerError, CodeInternal, message, nil)
+}
+
+// WriteDecodeError writes a 400 APIError for a request body that is not valid JSON for the expected type,
+// or a 413 APIError if the body was cut off by BodyLimitMiddleware
+func WriteDecodeError(w http.ResponseWriter, r *http.Request, message string, err error) {
+	// http.MaxBytesReader does not return a typed error
+	if err.Error() == "http: request body too large" {
+		WriteError(w, r, http.StatusRequestEntityTooLarge, CodeBodyTooLarge, message, err.Error())
+		return
+	}
+	WriteError(w, r, http.StatusBadRequest, CodeInvalidJSON, message, err.Error())
+}
+
+// RequestIDMiddleware tags every request with an ID, reusing the X-Request-ID header set by the Heroku router if present
+// the ID is echoed back in the X-Request-ID response header and included in error responses
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if len(requestID) == 0 {
+			id := make([]byte, 8)
+			rand.Read(id)
+			requestID = hex.EncodeToString(id)
+		}
+
+		w.Header().Set("X-Request-ID", requestID)
+		ctx := context.WithValue(r.Context(), requestIDContextKey, requestID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequestIDFromContext returns the request ID stored by RequestIDMiddleware
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey).(string)
+	return requestID
+}
+
+// BodyLimitMiddleware rejects request bodies larger than maxBytes
+// reads past the limit fail, which WriteDecodeError reports as 413 Request Entity Too Large
+func BodyLimitMiddleware(maxBytes int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > maxBytes {
+				WriteError(w, r, http.StatusRequestEntityTooLarge, CodeBodyTooLarge, "request body must not exceed "+strconv.FormatInt(maxBytes, 10)+" bytes", nil)
+				return
+			}
+
+			r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package lib
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidIfMatch is returned when an If-Match header does not contain a version ETag
+var ErrInvalidIfMatch = errors.New("If-Match must be an ETag previously returned by the server")
+
+// ETag formats a document version as a strong ETag
+func ETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// IfMatch returns the versions accepted by the If-Match header of a request, which may list several ETags
+// versions is nil when the header is absent or "*", in which case any version matches
+func IfMatch(r *http.Request) (versions []int64, err error) {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	if len(ifMatch) == 0 || ifMatch == "*" {
+		return nil, nil
+	}
+
+	for _, etag := range strings.Split(ifMatch, ",") {
+		etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+		if len(etag) < 2 || !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `"`) {
+			return nil, ErrInvalidIfMatch
+		}
+
+		version, err := strconv.ParseInt(etag[1:len(etag)-1], 10, 64)
+		if err != nil {
+			return nil, ErrInvalidIfMatch
+		}
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
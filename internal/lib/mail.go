@@ -0,0 +1,102 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer sends plain text emails
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+// NewMailer returns an SMTPMailer when SMTP_HOST is set, or a LogMailer when a developer sets MAIL_LOG_FILE instead
+// it fails without either so that a misconfigured server never writes password reset tokens anywhere but the inbox
+func NewMailer() (Mailer, error) {
+	host := os.Getenv("SMTP_HOST")
+	if len(host) == 0 {
+		path := os.Getenv("MAIL_LOG_FILE")
+		if len(path) == 0 {
+			return nil, errors.New("SMTP_HOST must be set, or MAIL_LOG_FILE for local development")
+		}
+		return &LogMailer{Path: path}, nil
+	}
+
+	port := os.Getenv("SMTP_PORT")
+	if len(port) == 0 {
+		port = "587"
+	}
+
+	return &SMTPMailer{
+		Host:     host,
+		Port:     port,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     os.Getenv("MAIL_FROM"),
+	}, nil
+}
+
+// SMTPMailer sends emails through an SMTP server
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+// Send sends an email through the configured SMTP server
+func (m *SMTPMailer) Send(to string, subject string, body string) error {
+	var auth smtp.Auth
+	if len(m.Username) > 0 {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	return smtp.SendMail(m.Host+":"+m.Port, auth, m.From, []string{to}, formatMessage(m.From, to, subject, body))
+}
+
+// LogMailer writes emails to a file for local development
+// emails are never written to the log since they contain single-use tokens
+type LogMailer struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// Send appends the email to the configured file
+func (m *LogMailer) Send(to string, subject string, body string) error {
+	if len(m.Path) == 0 {
+		return errors.New("LogMailer needs a file to write emails to")
+	}
+	message := formatMessage("", to, subject, body)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "%s\n%s\n", time.Now().Format(time.RFC3339), message)
+	return err
+}
+
+func formatMessage(from string, to string, subject string, body string) []byte {
+	var message strings.Builder
+	if len(from) > 0 {
+		message.WriteString("From: " + from + "\r\n")
+	}
+	message.WriteString("To: " + to + "\r\n")
+	message.WriteString("Subject: " + subject + "\r\n")
+	message.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	message.WriteString("\r\n")
+	message.WriteString(body + "\r\n")
+	return []byte(message.String())
+}
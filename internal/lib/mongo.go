@@ -2,27 +2,162 @@ package lib
 
 import (
 	"context"
+	"errors"
 	"log"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+const (
+	databaseName = "refactored_spoon_db"
+
+	defaultMaxPoolSize            = 100
+	defaultConnectTimeout         = 10 * time.Second
+	defaultServerSelectionTimeout = 10 * time.Second
+	defaultMaxConnIdleTime        = 5 * time.Minute
 )
 
 var (
 	dbConnStr = os.Getenv("DB_CONN_STR")
+
+	// client is shared by every collection, the driver pools connections inside it
+	clientMu sync.Mutex
+	client   *mongo.Client
 )
 
+// Connect creates the shared MongoDB client if needed and pings the primary to check the database is reachable
+func Connect(ctx context.Context) error {
+	c, err := getClient()
+	if err != nil {
+		return err
+	}
+	return c.Ping(ctx, readpref.Primary())
+}
+
+// Disconnect closes the shared MongoDB client, waiting for in-use connections to be returned to the pool
+func Disconnect(ctx context.Context) error {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+
+	if client == nil {
+		return nil
+	}
+	err := client.Disconnect(ctx)
+	client = nil
+	return err
+}
+
 // GetCollection returns a MongoDB collection given the collection name
 func GetCollection(collectionName string) *mongo.Collection {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	c, err := getClient()
+	if err != nil {
+		log.Fatalf("unable to create mongoDB client: %s\n", err.Error())
+	}
+
+	return c.Database(databaseName).Collection(collectionName)
+}
+
+// getClient returns the shared MongoDB client, creating it on first use
+func getClient() (*mongo.Client, error) {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+
+	if client != nil {
+		return client, nil
+	}
+
+	opts, err := clientOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := mongo.NewClient(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *opts.ConnectTimeout)
 	defer cancel()
 
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(dbConnStr))
+	// connecting only starts background monitoring, it does not wait for the server
+	if err := c.Connect(ctx); err != nil {
+		return nil, err
+	}
+
+	client = c
+	return client, nil
+}
+
+// clientOptions reads the pool size and timeouts from the environment
+//
+//	DB_MAX_POOL_SIZE              most open connections, default 100
+//	DB_MIN_POOL_SIZE              connections kept open while idle, default 0
+//	DB_CONNECT_TIMEOUT            e.g. 10s, default 10s
+//	DB_SERVER_SELECTION_TIMEOUT   how long an operation waits for a usable server, default 10s
+//	DB_MAX_CONN_IDLE_TIME         idle connections are closed after this long, default 5m
+func clientOptions() (*options.ClientOptions, error) {
+	if len(dbConnStr) == 0 {
+		return nil, errors.New("DB_CONN_STR is not set")
+	}
+
+	maxPoolSize, err := envUint("DB_MAX_POOL_SIZE", defaultMaxPoolSize)
 	if err != nil {
-		log.Fatalf("unable to create mongoDB client: %s\n", err.Error())
+		return nil, err
+	}
+	minPoolSize, err := envUint("DB_MIN_POOL_SIZE", 0)
+	if err != nil {
+		return nil, err
+	}
+	connectTimeout, err := envDuration("DB_CONNECT_TIMEOUT", defaultConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	serverSelectionTimeout, err := envDuration("DB_SERVER_SELECTION_TIMEOUT", defaultServerSelectionTimeout)
+	if err != nil {
+		return nil, err
 	}
+	maxConnIdleTime, err := envDuration("DB_MAX_CONN_IDLE_TIME", defaultMaxConnIdleTime)
+	if err != nil {
+		return nil, err
+	}
+
+	return options.Client().
+		ApplyURI(dbConnStr).
+		SetMaxPoolSize(maxPoolSize).
+		SetMinPoolSize(minPoolSize).
+		SetConnectTimeout(connectTimeout).
+		SetServerSelectionTimeout(serverSelectionTimeout).
+		SetMaxConnIdleTime(maxConnIdleTime), nil
+}
 
-	return client.Database("refactored_spoon_db").Collection(collectionName)
+func envUint(name string, defaultValue uint64) (uint64, error) {
+	value := os.Getenv(name)
+	if len(value) == 0 {
+		return defaultValue, nil
+	}
+
+	parsed, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, errors.New(name + " must be a non-negative integer: " + value)
+	}
+	return parsed, nil
+}
+
+func envDuration(name string, defaultValue time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if len(value) == 0 {
+		return defaultValue, nil
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed <= 0 {
+		return 0, errors.New(name + " must be a positive duration such as 10s: " + value)
+	}
+	return parsed, nil
 }
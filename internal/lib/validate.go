@@ -0,0 +1,203 @@
+package lib
+
+import (
+	"net/http"
+	"net/mail"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FieldError describes why a single field of a request failed validation
+type FieldError struct {
+	Field   string `json:"field"` // JSON path of the field, e.g. foods[0].serving
+	Message string `json:"message"`
+}
+
+// ValidationErrors are all the field errors of a request
+type ValidationErrors []FieldError
+
+func (errs ValidationErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Field + " " + err.Message
+	}
+	return strings.Join(messages, ", ")
+}
+
+// Validate checks v against the rules in the validate struct tags of its fields, recursing into nested structs and slices
+// it returns nil if v is valid and ValidationErrors otherwise
+//
+// supported rules, separated by commas:
+//
+//	required   the field must not be the zero value
+//	min=N      numbers must be at least N, strings and slices must have at least N characters or elements
+//	max=N      numbers must be at most N, strings and slices must have at most N characters or elements
+//	gt=N       numbers must be greater than N
+//	maxbytes=N strings must be at most N bytes long in UTF-8, e.g. for limits of byte-oriented algorithms like bcrypt
+//	oneof=a b  strings must be one of the space separated values, or of the | separated values if they contain spaces
+//	email      strings must be an email address
+//	date       strings must be a YYYY-MM-DD date
+//	dive       the rules after dive apply to every element of a slice
+//
+// rules other than required are skipped for zero fields, so optional fields only need to be valid when set,
+// but always apply to slice elements after dive
+func Validate(v interface{}) error {
+	var errs ValidationErrors
+	validateValue(reflect.ValueOf(v), "", &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// WriteValidationError writes a 422 APIError listing the field errors of a request
+func WriteValidationError(w http.ResponseWriter, r *http.Request, err error) {
+	WriteError(w, r, http.StatusUnprocessableEntity, CodeValidationFailed, "request failed validation", err)
+}
+
+func validateValue(value reflect.Value, path string, errs *ValidationErrors) {
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return
+		}
+		value = value.Elem()
+	}
+
+	switch value.Kind() {
+	case reflect.Struct:
+		valueType := value.Type()
+		for i := 0; i < value.NumField(); i++ {
+			field := valueType.Field(i)
+			if len(field.PkgPath) > 0 {
+				continue // unexported
+			}
+
+			fieldPath := joinPath(path, jsonName(field))
+			if rules := field.Tag.Get("validate"); len(rules) > 0 {
+				validateRules(value.Field(i), fieldPath, strings.Split(rules, ","), true, errs)
+			}
+			validateValue(value.Field(i), fieldPath, errs)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			validateValue(value.Index(i), path+"["+strconv.Itoa(i)+"]", errs)
+		}
+	}
+}
+
+// optional is false for slice elements, which are checked even when they are the zero value
+func validateRules(value reflect.Value, path string, rules []string, optional bool, errs *ValidationErrors) {
+	for i, rule := range rules {
+		name, param := rule, ""
+		if idx := strings.Index(rule, "="); idx >= 0 {
+			name, param = rule[:idx], rule[idx+1:]
+		}
+
+		if name == "dive" {
+			if value.Kind() == reflect.Slice || value.Kind() == reflect.Array {
+				for j := 0; j < value.Len(); j++ {
+					validateRules(value.Index(j), path+"["+strconv.Itoa(j)+"]", rules[i+1:], false, errs)
+				}
+			}
+			return
+		}
+
+		if name == "required" {
+			if value.IsZero() {
+				*errs = append(*errs, FieldError{Field: path, Message: "is required"})
+				return
+			}
+			continue
+		}
+
+		if optional && value.IsZero() {
+			continue
+		}
+
+		if message := checkRule(value, name, param); len(message) > 0 {
+			*errs = append(*errs, FieldError{Field: path, Message: message})
+			return
+		}
+	}
+}
+
+// checkRule returns why value breaks the rule, or an empty string if it doesn't
+func checkRule(value reflect.Value, name string, param string) string {
+	switch name {
+	case "min", "max", "gt":
+		limit, _ := strconv.ParseFloat(param, 64)
+		size, isLength := measure(value)
+		switch {
+		case name == "min" && size < limit && isLength:
+			return "must have at least " + param + " characters or elements"
+		case name == "min" && size < limit:
+			return "must be at least " + param
+		case name == "max" && size > limit && isLength:
+			return "must have at most " + param + " characters or elements"
+		case name == "max" && size > limit:
+			return "must be at most " + param
+		case name == "gt" && size <= limit:
+			return "must be greater than " + param
+		}
+	case "maxbytes":
+		limit, _ := strconv.Atoi(param)
+		if len(value.String()) > limit {
+			return "must be at most " + param + " bytes long"
+		}
+	case "oneof":
+		options := strings.Fields(param)
+		if strings.Contains(param, "|") {
+			options = strings.Split(param, "|")
+		}
+		for _, option := range options {
+			if value.String() == option {
+				return ""
+			}
+		}
+		return "must be one of " + strings.Join(options, ", ")
+	case "email":
+		address, err := mail.ParseAddress(value.String())
+		if err != nil || address.Address != value.String() {
+			return "must be an email address"
+		}
+	case "date":
+		if _, err := time.Parse("2006-01-02", value.String()); err != nil {
+			return "must be a date in YYYY-MM-DD format"
+		}
+	}
+	return ""
+}
+
+// measure returns the numeric value of numbers, and the length of strings and slices
+func measure(value reflect.Value) (size float64, isLength bool) {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), false
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), false
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), false
+	case reflect.String:
+		return float64(len([]rune(value.String()))), true
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return float64(value.Len()), true
+	}
+	return 0, false
+}
+
+func jsonName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if len(name) == 0 || name == "-" {
+		return field.Name
+	}
+	return name
+}
+
+func joinPath(path string, name string) string {
+	if len(path) == 0 {
+		return name
+	}
+	return path + "." + name
+}
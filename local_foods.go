@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/refactored-spoon-backend/internal/fdc"
+	"github.com/refactored-spoon-backend/internal/lib"
+)
+
+// foodImportBatchSize is how many foods are written to the store at once while importing
+const foodImportBatchSize = 1000
+
+var (
+	// errUnknownFdcID is returned by LocalFoodSource for foods that are not in the imported dataset
+	errUnknownFdcID = errors.New("could not find food in the local FoodData Central dataset")
+	// errFoodIndexLoading is returned by LocalFoodSource searches until its search index has been built
+	errFoodIndexLoading = errors.New("the local food search index is still being built")
+)
+
+const (
+	// foodReindexTimeout bounds rebuilding the search index, which reads every food
+	foodReindexTimeout = 30 * time.Minute
+	// searchPageListSize is how many page numbers a search result lists
+	searchPageListSize = 10
+)
+
+// LocalFoodSource is a FoodSource serving the foods imported from the FoodData Central downloads by ImportFoods,
+// so that the server can run without a USDA API key and answers the same way every time
+// searches go through an in-memory index of the foods that has to be rebuilt to pick up newly imported ones
+type LocalFoodSource struct {
+	store FoodStore
+	days  DayStore // to boost the foods a user logged before, nil to rank every user alike
+	now   func() time.Time
+
+	mu         sync.RWMutex
+	index      *foodIndex
+	reindexing bool
+}
+
+// NewLocalFoodSource returns a FoodSource serving the foods in store, whose searches fail with errFoodIndexLoading
+// until Reindex has been called
+func NewLocalFoodSource(store FoodStore, days DayStore) *LocalFoodSource {
+	return &LocalFoodSource{store: store, days: days, now: time.Now}
+}
+
+// Reindex rebuilds the search index from the store, searches keep using the previous index meanwhile
+func (l *LocalFoodSource) Reindex(ctx context.Context) error {
+	index, err := buildFoodIndex(ctx, l.store)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.index = index
+	return nil
+}
+
+// StartReindex rebuilds the search index in the background unless that is already happening, reporting whether it started
+func (l *LocalFoodSource) StartReindex() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.reindexing {
+		return false
+	}
+	l.reindexing = true
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), foodReindexTimeout)
+		defer cancel()
+
+		start := l.now()
+		if err := l.Reindex(ctx); err != nil {
+			log.Println("unable to index local foods: " + err.Error())
+		} else {
+			log.Println("indexed local foods in " + l.now().Sub(start).String())
+		}
+
+		l.mu.Lock()
+		l.reindexing = false
+		l.mu.Unlock()
+	}()
+	return true
+}
+
+// Search returns a page of the imported foods matching the search criteria, with abridged nutrients
+// words match by prefix and with typos, and the foods the signed in user logged recently rank higher
+func (l *LocalFoodSource) Search(ctx context.Context, criteria fdc.FoodSearchCriteria) (*fdc.FoodSearchResult, error) {
+	l.mu.RLock()
+	index := l.index
+	l.mu.RUnlock()
+	if index == nil {
+		return nil, errFoodIndexLoading
+	}
+
+	query := foodSearch{criteria: normalizeSearchCriteria(criteria)}
+	if userID := lib.UserIDFromContext(ctx); len(userID) > 0 && l.days != nil {
+		logged, err := recentlyLoggedFoods(ctx, l.days, userID, l.now())
+		if err != nil {
+			// ranking without the boost beats failing the search
+			log.Println("unable to read the foods logged by " + userID + ": " + err.Error())
+		}
+		query.logged = logged
+	}
+
+	fdcIDs, total := index.search(query)
+	foods, err := l.store.GetFoods(ctx, fdcIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	totalPages := (total + query.criteria.PageSize - 1) / query.criteria.PageSize
+	result := &fdc.FoodSearchResult{
+		FoodSearchCriteria: query.criteria,
+		TotalHits:          total,
+		CurrentPage:        query.criteria.PageNumber,
+		TotalPages:         totalPages,
+		PageList:           pageList(query.criteria.PageNumber, totalPages),
+		Foods:              make([]fdc.UsdaFood, len(foods)),
+	}
+	for i, food := range foods {
+		result.Foods[i] = food.Abridged()
+	}
+	return result, nil
+}
+
+// pageList returns up to searchPageListSize page numbers around the current page like USDA does,
+// starting at the first page and ending at the last one when the current page is close to them
+func pageList(current int, totalPages int) []int {
+	first := current - searchPageListSize/2
+	if last := first + searchPageListSize - 1; last > totalPages {
+		first -= last - totalPages
+	}
+	if first < 1 {
+		first = 1
+	}
+
+	pages := make([]int, 0, searchPageListSize)
+	for page := first; page <= totalPages && len(pages) < searchPageListSize; page++ {
+		pages = append(pages, page)
+	}
+	return pages
+}
+
+// Food returns the imported food with the given FoodData Central ID, or errUnknownFdcID
+func (l *LocalFoodSource) Food(ctx context.Context, fdcID int) (*fdc.FoodDetailResult, error) {
+	foods, err := l.store.GetFoods(ctx, []int{fdcID})
+	if err != nil {
+		return nil, err
+	}
+	if len(foods) == 0 {
+		return nil, errUnknownFdcID
+	}
+	return &foods[0], nil
+}
+
+// Foods returns the imported foods with the given FoodData Central IDs, leaving out unknown IDs like USDA does
+func (l *LocalFoodSource) Foods(ctx context.Context, fdcIDs []int) ([]fdc.FoodDetailResult, error) {
+	return l.store.GetFoods(ctx, fdcIDs)
+}
+
+// FoodImportReport is the result of importing a FoodData Central download
+type FoodImportReport struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"` // foods without an fdcId or description
+}
+
+// ImportFoods saves every food that read passes to its callback in store, in batches,
+// replacing foods imported before so that a newer download can be imported over an older one
+func ImportFoods(ctx context.Context, store FoodStore, read func(fn func(fdc.FoodDetailResult) error) error) (*FoodImportReport, error) {
+	report := &FoodImportReport{}
+	batch := make([]fdc.FoodDetailResult, 0, foodImportBatchSize)
+	flush := func() error {
+		if err := store.SaveFoods(ctx, batch); err != nil {
+			return err
+		}
+		report.Imported += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	err := read(func(food fdc.FoodDetailResult) error {
+		if food.FdcId <= 0 || len(food.Description) == 0 {
+			report.Skipped++
+			return nil
+		}
+		batch = append(batch, food)
+		if len(batch) < foodImportBatchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// runImportFoods is the import-foods CLI subcommand, it takes the path of a JSON download or an extracted CSV download
+func runImportFoods(args []string) int {
+	flags := flag.NewFlagSet("import-foods", flag.ExitOnError)
+	format := flags.String("format", "", "json or csv, by default csv for directories and json for files")
+	timeout := flags.Duration("timeout", 2*time.Hour, "give up after this long")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: refactored-spoon-backend import-foods [-format json|csv] [-timeout 2h] path")
+		return 2
+	}
+	path := flags.Arg(0)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "unable to read dataset: "+err.Error())
+		return 1
+	}
+	if len(*format) == 0 {
+		*format = "json"
+		if info.IsDir() {
+			*format = "csv"
+		}
+	}
+
+	var read func(fn func(fdc.FoodDetailResult) error) error
+	switch *format {
+	case "csv":
+		read = func(fn func(fdc.FoodDetailResult) error) error {
+			return fdc.ReadCSVDataset(path, fn)
+		}
+	case "json":
+		read = func(fn func(fdc.FoodDetailResult) error) error {
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			return fdc.ReadJSONDataset(file, fn)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "unknown dataset format: "+*format)
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	defer lib.Disconnect(context.Background())
+
+	report, err := ImportFoods(ctx, NewMongoFoodStore(lib.GetCollection("Foods")), read)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to import foods after %d: %s\n", report.Imported, err.Error())
+		return 1
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+	fmt.Fprintln(os.Stderr, "running servers pick up the imported foods on restart or POST /admin/foods/reindex")
+	return 0
+}
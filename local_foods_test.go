@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/refactored-spoon-backend/internal/fdc"
+	"github.com/refactored-spoon-backend/internal/lib"
+)
+
+// testDatasetJSON is a FoodData Central JSON download with a food that cannot be imported
+const testDatasetJSON = `{"FoundationFoods": [
+	{"fdcId": 1105314, "dataType": "Foundation", "foodClass": "FinalFood", "description": "Bananas, raw", "publicationDate": "10/30/2020",
+	 "foodNutrients": [{"type": "FoodNutrient", "id": 1, "nutrient": {"id": 1008, "number": "208", "name": "Energy", "rank": 300, "unitName": "kcal"}, "amount": 89}]},
+	{"fdcId": 2344720, "dataType": "Branded", "foodClass": "Branded", "description": "Banana chips", "brandOwner": "Crunchy Co",
+	 "gtinUpc": "012345678905", "ingredients": "BANANAS, COCONUT OIL, SUGAR", "servingSize": 30, "servingSizeUnit": "g", "publicationDate": "4/1/2022",
+	 "foodNutrients": [{"type": "FoodNutrient", "id": 2, "nutrient": {"id": 1008, "number": "208", "name": "Energy", "rank": 300, "unitName": "kcal"}, "amount": 519}]},
+	{"fdcId": 2344721, "dataType": "Branded", "description": "Plantain chips", "brandOwner": "Crunchy Co", "ingredients": "PLANTAINS, SALT", "publicationDate": "3/15/2021"},
+	{"fdcId": 0, "description": "no ID"}
+]}`
+
+// testDatasetCSV is the extracted FoodData Central CSV download of the foods in testDatasetJSON, plus a sample
+var testDatasetCSV = map[string]string{
+	"food.csv": "\ufeff" + `"fdc_id","data_type","description","food_category_id","publication_date"
+"1105314","foundation_food","Bananas, raw","9","2020-10-30"
+"1105315","sub_sample_food","Bananas, raw, sample 1","9","2020-10-30"
+"2344720","branded_food","Banana chips","","2022-04-01"
+"2344721","branded_food","Plantain chips","","2022-04-01"
+`,
+	"nutrient.csv": `"id","name","unit_name","nutrient_nbr","rank"
+"1008","Energy","KCAL","208","300"
+`,
+	"food_nutrient.csv": `"id","fdc_id","nutrient_id","amount","data_points"
+"1","1105314","1008","89",""
+"2","2344720","1008","519",""
+"3","1105315","1008","90",""
+`,
+	"branded_food.csv": `"fdc_id","brand_owner","gtin_upc","ingredients","serving_size","serving_size_unit"
+"2344720","Crunchy Co","012345678905","BANANAS, COCONUT OIL, SUGAR","30","g"
+"2344721","Crunchy Co","","PLANTAINS, SALT","",""
+`,
+}
+
+// importTestDataset returns a store holding the foods of testDatasetJSON
+func importTestDataset(t *testing.T) *MemoryFoodStore {
+	t.Helper()
+	store := NewMemoryFoodStore()
+	report, err := ImportFoods(context.Background(), store, func(fn func(fdc.FoodDetailResult) error) error {
+		return fdc.ReadJSONDataset(strings.NewReader(testDatasetJSON), fn)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported != 3 || report.Skipped != 1 {
+		t.Fatalf("got import report %+v, want 3 imported and 1 skipped", report)
+	}
+	return store
+}
+
+func TestReadCSVDataset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fdc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range testDatasetCSV {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []fdc.FoodDetailResult
+	if err := fdc.ReadCSVDataset(dir, func(food fdc.FoodDetailResult) error {
+		got = append(got, food)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the CSV download has no food class and spells units in capitals
+	energy := fdc.USDANutrient{Id: 1008, Number: "208", Name: "Energy", Rank: 300, UnitName: "KCAL"}
+	want := []fdc.FoodDetailResult{
+		{FdcId: 1105314, DataType: fdc.DataTypeFoundation, Description: "Bananas, raw", PublicationDate: "10/30/2020",
+			FoodNutrients: []fdc.FoodNutrient{{Type: "FoodNutrient", Id: 1, Nutrient: energy, Amount: 89}}},
+		{FdcId: 2344720, DataType: fdc.DataTypeBranded, Description: "Banana chips", BrandOwner: "Crunchy Co",
+			GtinUpc: "012345678905", Ingredients: "BANANAS, COCONUT OIL, SUGAR", ServingSize: 30, ServingSizeUnit: "g", PublicationDate: "4/1/2022",
+			FoodNutrients: []fdc.FoodNutrient{{Type: "FoodNutrient", Id: 2, Nutrient: energy, Amount: 519}}},
+		{FdcId: 2344721, DataType: fdc.DataTypeBranded, Description: "Plantain chips", BrandOwner: "Crunchy Co", Ingredients: "PLANTAINS, SALT", PublicationDate: "4/1/2022"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got foods\n%+v\nwant\n%+v", got, want)
+	}
+
+	// a malformed value names the file and record
+	ioutil.WriteFile(filepath.Join(dir, "food_nutrient.csv"), []byte("\"id\",\"fdc_id\",\"nutrient_id\",\"amount\"\n\"1\",\"1105314\",\"1008\",\"lots\"\n"), 0600)
+	err = fdc.ReadCSVDataset(dir, func(fdc.FoodDetailResult) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "food_nutrient.csv record 2: invalid amount") {
+		t.Errorf("got error %v for a malformed amount", err)
+	}
+}
+
+func TestReadJSONDataset(t *testing.T) {
+	store := importTestDataset(t)
+	foods, err := store.GetFoods(context.Background(), []int{2344720})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(foods) != 1 || foods[0].BrandOwner != "Crunchy Co" || foods[0].GtinUpc != "012345678905" || len(foods[0].FoodNutrients) != 1 {
+		t.Errorf("got foods %+v", foods)
+	}
+
+	for _, malformed := range []string{`[]`, `{"FoundationFoods": {}}`, `{"FoundationFoods": [{"fdcId": "1"}]}`} {
+		if err := fdc.ReadJSONDataset(strings.NewReader(malformed), func(fdc.FoodDetailResult) error { return nil }); err == nil {
+			t.Errorf("got no error reading %s", malformed)
+		}
+	}
+}
+
+func TestLocalFoodRoutes(t *testing.T) {
+	s, _ := newTestServer(t)
+	local := NewLocalFoodSource(importTestDataset(t), nil)
+	if err := local.Reindex(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s.foods = local
+	h := s.Handler()
+
+	tests := []struct {
+		name    string
+		path    string
+		body    interface{}
+		want    int
+		wantErr string
+		wantIDs []int
+	}{
+		{name: "search ranks description matches first", path: "/food/search", body: fdc.FoodSearchCriteria{GeneralSearchInput: "Bananas"}, want: http.StatusOK, wantIDs: []int{1105314, 2344720}},
+		{name: "search any word", path: "/food/search", body: fdc.FoodSearchCriteria{GeneralSearchInput: "banana chips"}, want: http.StatusOK, wantIDs: []int{2344720, 2344721, 1105314}},
+		{name: "search all words", path: "/food/search", body: fdc.FoodSearchCriteria{GeneralSearchInput: "banana chips", RequireAllWords: true}, want: http.StatusOK, wantIDs: []int{2344720}},
+		{name: "search by brand", path: "/food/search", body: fdc.FoodSearchCriteria{GeneralSearchInput: "crunchy"}, want: http.StatusOK, wantIDs: []int{2344720, 2344721}},
+		{name: "search second page", path: "/food/search", body: fdc.FoodSearchCriteria{GeneralSearchInput: "chips", PageNumber: 2, PageSize: 1}, want: http.StatusOK, wantIDs: []int{2344721}},
+		{name: "search without matches", path: "/food/search", body: fdc.FoodSearchCriteria{GeneralSearchInput: "kale"}, want: http.StatusOK, wantIDs: []int{}},
+		{name: "detail", path: "/food/detail", body: FoodDetailRequest{FdcId: 2344720}, want: http.StatusOK, wantIDs: []int{2344720}},
+		{name: "detail of unknown food", path: "/food/detail", body: FoodDetailRequest{FdcId: 42}, want: http.StatusNotFound, wantErr: lib.CodeNotFound},
+		{name: "foods detail keeps order and leaves out unknown foods", path: "/foods/detail", body: FoodsDetailRequest{FdcIds: []int{2344721, 42, 1105314}}, want: http.StatusOK, wantIDs: []int{2344721, 1105314}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(t, h, http.MethodPost, tt.path, "", tt.body, nil)
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+			if len(tt.wantErr) > 0 {
+				var apiErr lib.APIError
+				decodeResponse(t, w, &apiErr)
+				if apiErr.Code != tt.wantErr {
+					t.Errorf("got error code %q, want %q", apiErr.Code, tt.wantErr)
+				}
+				return
+			}
+
+			if got := localFoodIDs(t, tt.path, w); !reflect.DeepEqual(got, tt.wantIDs) {
+				t.Errorf("got foods %v, want %v", got, tt.wantIDs)
+			}
+		})
+	}
+
+	var result fdc.FoodSearchResult
+	decodeResponse(t, serve(t, h, http.MethodPost, "/food/search", "", fdc.FoodSearchCriteria{GeneralSearchInput: "chips", PageSize: 1}, nil), &result)
+	if result.CurrentPage != 1 || result.TotalPages != 2 || result.Foods[0].FoodNutrients[0].Value != 519 {
+		t.Errorf("got search result %+v", result)
+	}
+}
+
+// localFoodIDs returns the fdcIds of the foods in a response of the food route at path
+func localFoodIDs(t *testing.T, path string, w *httptest.ResponseRecorder) []int {
+	t.Helper()
+	ids := make([]int, 0)
+	switch path {
+	case "/food/search":
+		var result fdc.FoodSearchResult
+		decodeResponse(t, w, &result)
+		for _, food := range result.Foods {
+			ids = append(ids, food.FdcId)
+		}
+	case "/food/detail":
+		var food fdc.FoodDetailResult
+		decodeResponse(t, w, &food)
+		ids = append(ids, food.FdcId)
+	default:
+		var foods []fdc.FoodDetailResult
+		decodeResponse(t, w, &foods)
+		for _, food := range foods {
+			ids = append(ids, food.FdcId)
+		}
+	}
+	return ids
+}
@@ -1,23 +1,81 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/refactored-spoon-backend/internal/fdc"
 	"github.com/refactored-spoon-backend/internal/lib"
 )
 
+const (
+	// maxRequestBodyBytes is the largest request body accepted, a day of meals is far smaller
+	maxRequestBodyBytes = 1 << 20
+
+	// shutdownTimeout bounds how long in-flight requests get to finish, Heroku kills the process 30s after SIGTERM
+	shutdownTimeout = 20 * time.Second
+)
+
 func main() {
+	// subcommands run a maintenance job instead of the server
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "repair-nutrition":
+			os.Exit(runRepairNutrition(os.Args[2:]))
+		case "import-foods":
+			os.Exit(runImportFoods(os.Args[2:]))
+		default:
+			log.Fatalf("unknown subcommand: %s\n", os.Args[1])
+		}
+	}
+
 	log.Println("refactored spoon server start")
 
-	router := mux.NewRouter().StrictSlash(true)
+	mailer, err := lib.NewMailer()
+	if err != nil {
+		log.Fatalf("unable to configure mailer: %s\n", err.Error())
+	}
 
-	handleDayRequests(router)
-	handleUserRequests(router)
-	handleUSDARequests(router)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	if err := lib.Connect(ctx); err != nil {
+		log.Fatalf("unable to connect to mongoDB: %s\n", err.Error())
+	}
+
+	days := NewMongoDayStore(lib.GetCollection("Days"))
+	if err := days.MigrateDates(ctx); err != nil {
+		log.Println("unable to migrate day dates: " + err.Error())
+	}
+	// without the unique day index concurrent writes could split a day into several documents
+	if err := days.EnsureIndexes(ctx); err != nil {
+		log.Fatalf("unable to create day indexes: %s\n", err.Error())
+	}
+	users := NewMongoUserStore(lib.GetCollection("Users"), lib.GetCollection("AccountTokens"))
+	// without the unique email index concurrent signups could create two users with the same email
+	if err := users.EnsureIndexes(ctx); err != nil {
+		log.Fatalf("unable to create user indexes: %s\n", err.Error())
+	}
+	foods, err := newFoodSource(ctx, days)
+	if err != nil {
+		log.Fatalf("unable to configure food source: %s\n", err.Error())
+	}
+	cancel()
+
+	s := newServer(
+		days,
+		users,
+		NewMongoSessionStore(lib.GetCollection("Sessions")),
+		mailer,
+		foods,
+	)
 
 	// get port as environment variable since Heroku sets PORT variable dynamically
 	// https://devcenter.heroku.com/articles/runtime-principles#web-servers
@@ -26,29 +84,172 @@ func main() {
 		port = "8081"
 	}
 
-	server := &http.Server{
-		Handler:      router,
+	httpServer := &http.Server{
+		Handler:      s.Handler(),
 		Addr:         ":" + port,
 		WriteTimeout: 8 * time.Second,
 		ReadTimeout:  8 * time.Second,
 	}
 
-	log.Fatal(server.ListenAndServe())
+	// stop accepting requests on SIGTERM (sent by Heroku on restarts) and let in-flight ones and background work finish
+	// before closing the database connections they use
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		sig := <-signals
+		log.Println("received " + sig.String() + ", shutting down")
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		if err := httpServer.Shutdown(ctx); err != nil {
+			log.Println("unable to drain in-flight requests: " + err.Error())
+		}
+		s.background.Wait()
+		if err := lib.Disconnect(ctx); err != nil {
+			log.Println("unable to disconnect from mongoDB: " + err.Error())
+		}
+		close(stopped)
+	}()
+
+	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
+	log.Println("refactored spoon server stopped")
+}
+
+// newFoodSource returns the FoodSource selected by FOOD_SOURCE, either "usda" (the default) for the cached USDA API
+// or "local" for the foods imported into the Foods collection with the import-foods subcommand
+func newFoodSource(ctx context.Context, days DayStore) (FoodSource, error) {
+	switch source := os.Getenv("FOOD_SOURCE"); source {
+	case "", "usda":
+		usda, err := fdc.NewClientFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		foodCacheSize, err := envInt("FOOD_CACHE_SIZE", defaultFoodCacheSize)
+		if err != nil {
+			return nil, err
+		}
+
+		foodCache := NewMongoFoodCacheStore(lib.GetCollection("FoodCache"))
+		if err := foodCache.EnsureIndexes(ctx); err != nil {
+			log.Println("unable to create food cache indexes: " + err.Error())
+		}
+		return NewCachedFoodSource(usda, foodCache, foodCacheSize), nil
+	case "local":
+		// building the search index reads every food, so searches answer 503 until it is done
+		localFoods := NewLocalFoodSource(NewMongoFoodStore(lib.GetCollection("Foods")), days)
+		localFoods.StartReindex()
+		return localFoods, nil
+	default:
+		return nil, errors.New("FOOD_SOURCE must be usda or local: " + source)
+	}
+}
+
+// envInt reads a non-negative integer from the environment, or returns defaultValue if it is not set
+func envInt(name string, defaultValue int) (int, error) {
+	value := os.Getenv(name)
+	if len(value) == 0 {
+		return defaultValue, nil
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 0 {
+		return 0, errors.New(name + " must be a non-negative integer: " + value)
+	}
+	return parsed, nil
+}
+
+// server holds the stores and services the handlers depend on
+type server struct {
+	days     DayStore
+	users    UserStore
+	sessions SessionStore
+	mailer   lib.Mailer
+	foods    FoodSource
+
+	// background tracks work that outlives its request, like password reset emails, so shutdown can wait for it
+	background sync.WaitGroup
+
+	// authMiddleware authenticates requests and rejects tokens of revoked sessions
+	authMiddleware func(http.Handler) http.Handler
+	// optionalAuthMiddleware does the same for requests with a token and lets anonymous requests through
+	optionalAuthMiddleware func(http.Handler) http.Handler
+	// adminMiddleware only lets through requests with the ADMIN_API_KEY the server was created with
+	adminMiddleware func(http.Handler) http.Handler
+}
+
+func newServer(days DayStore, users UserStore, sessions SessionStore, mailer lib.Mailer, foods FoodSource) *server {
+	s := &server{days: days, users: users, sessions: sessions, mailer: mailer, foods: foods}
+	s.authMiddleware = lib.AuthMiddleware(s.checkSession)
+	s.optionalAuthMiddleware = lib.OptionalAuthMiddleware(s.checkSession)
+	s.adminMiddleware = lib.AdminMiddleware(os.Getenv("ADMIN_API_KEY"))
+	return s
+}
+
+// Handler returns the handler serving every route, wrapped in the middleware shared by all of them
+func (s *server) Handler() http.Handler {
+	router := mux.NewRouter().StrictSlash(true)
+
+	s.handleDayRequests(router)
+	s.handleReportRequests(router)
+	s.handleUserRequests(router)
+	s.handleSessionRequests(router)
+	s.handleUSDARequests(router)
+	s.handleAdminRequests(router)
+
+	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lib.WriteError(w, r, http.StatusNotFound, lib.CodeNotFound, "no route for "+r.URL.Path, nil)
+	})
+	router.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lib.WriteError(w, r, http.StatusMethodNotAllowed, lib.CodeMethodNotAllowed, r.Method+" is not allowed on "+r.URL.Path, nil)
+	})
+
+	return lib.RequestIDMiddleware(lib.BodyLimitMiddleware(maxRequestBodyBytes)(router))
+}
+
+func (s *server) handleDayRequests(router *mux.Router) {
+	router.Handle("/days", lib.CorsMiddleware(s.authMiddleware(http.HandlerFunc(s.DaysHandler)))).Methods(http.MethodGet, http.MethodOptions)
+	router.Handle("/days/{date}", lib.CorsMiddleware(s.authMiddleware(http.HandlerFunc(s.DayHandler)))).Methods(http.MethodGet, http.MethodDelete, http.MethodOptions)
+	router.Handle("/days/{date}/meals", lib.CorsMiddleware(s.authMiddleware(http.HandlerFunc(s.MealsHandler)))).Methods(http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodOptions)
+	router.Handle("/days/{date}/meals/{mealId}", lib.CorsMiddleware(s.authMiddleware(http.HandlerFunc(s.MealHandler)))).Methods(http.MethodGet, http.MethodDelete, http.MethodPut, http.MethodOptions)
+	router.Handle("/days/{date}/meals/{mealId}/foods", lib.CorsMiddleware(s.authMiddleware(http.HandlerFunc(s.FoodsHandler)))).Methods(http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodOptions)
+	router.Handle("/days/{date}/meals/{mealId}/foods/{foodId}", lib.CorsMiddleware(s.authMiddleware(http.HandlerFunc(s.FoodHandler)))).Methods(http.MethodGet, http.MethodPut, http.MethodDelete, http.MethodOptions)
+}
+
+func (s *server) handleReportRequests(router *mux.Router) {
+	router.Handle("/reports/weekly", lib.CorsMiddleware(s.authMiddleware(http.HandlerFunc(s.WeeklyReportHandler)))).Methods(http.MethodGet, http.MethodOptions)
+	router.Handle("/reports/monthly", lib.CorsMiddleware(s.authMiddleware(http.HandlerFunc(s.MonthlyReportHandler)))).Methods(http.MethodGet, http.MethodOptions)
+}
+
+func (s *server) handleUserRequests(router *mux.Router) {
+	router.Handle("/signup", lib.CorsMiddleware(http.HandlerFunc(s.Signup))).Methods(http.MethodPost, http.MethodOptions)
+	router.Handle("/login", lib.CorsMiddleware(http.HandlerFunc(s.Login))).Methods(http.MethodPost, http.MethodOptions)
+	router.Handle("/password/forgot", lib.CorsMiddleware(http.HandlerFunc(s.ForgotPassword))).Methods(http.MethodPost, http.MethodOptions)
+	router.Handle("/password/reset", lib.CorsMiddleware(http.HandlerFunc(s.ResetPassword))).Methods(http.MethodPost, http.MethodOptions)
+	router.Handle("/email/verify", lib.CorsMiddleware(http.HandlerFunc(s.VerifyEmail))).Methods(http.MethodPost, http.MethodOptions)
+	router.Handle("/users/me/profile", lib.CorsMiddleware(s.authMiddleware(http.HandlerFunc(s.ProfileHandler)))).Methods(http.MethodGet, http.MethodPut, http.MethodOptions)
+	router.Handle("/users/me/goals", lib.CorsMiddleware(s.authMiddleware(http.HandlerFunc(s.GoalsHandler)))).Methods(http.MethodGet, http.MethodPut, http.MethodOptions)
 }
 
-func handleDayRequests(router *mux.Router) {
-	router.Handle("/days/{date}", lib.CorsMiddleware(http.HandlerFunc(DayHandler))).Methods(http.MethodGet, http.MethodDelete, http.MethodOptions)
-	router.Handle("/days/{date}/meals", lib.CorsMiddleware(http.HandlerFunc(MealsHandler))).Methods(http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodOptions)
-	router.Handle("/days/{date}/meals/{mealId}", lib.CorsMiddleware(http.HandlerFunc(MealHandler))).Methods(http.MethodGet, http.MethodDelete, http.MethodPut, http.MethodOptions)
+func (s *server) handleSessionRequests(router *mux.Router) {
+	router.Handle("/sessions", lib.CorsMiddleware(s.authMiddleware(http.HandlerFunc(s.SessionsHandler)))).Methods(http.MethodGet, http.MethodDelete, http.MethodOptions)
+	router.Handle("/sessions/refresh", lib.CorsMiddleware(http.HandlerFunc(s.RefreshSession))).Methods(http.MethodPost, http.MethodOptions)
+	router.Handle("/sessions/{sessionId}", lib.CorsMiddleware(s.authMiddleware(http.HandlerFunc(s.SessionHandler)))).Methods(http.MethodDelete, http.MethodOptions)
 }
 
-func handleUserRequests(router *mux.Router) {
-	router.Handle("/signup", lib.CorsMiddleware(http.HandlerFunc(Signup))).Methods(http.MethodPost, http.MethodOptions)
-	router.Handle("/login", lib.CorsMiddleware(http.HandlerFunc(Login))).Methods(http.MethodPost, http.MethodOptions)
+func (s *server) handleUSDARequests(router *mux.Router) {
+	// signed in users get the foods they logged before ranked higher by the local food source
+	router.Handle("/food/search", lib.CorsMiddleware(s.optionalAuthMiddleware(http.HandlerFunc(s.SearchFood)))).Methods(http.MethodPost, http.MethodOptions)
+	router.Handle("/food/detail", lib.CorsMiddleware(http.HandlerFunc(s.FoodDetail))).Methods(http.MethodPost, http.MethodOptions)
+	router.Handle("/foods/detail", lib.CorsMiddleware(http.HandlerFunc(s.FoodsDetail))).Methods(http.MethodPost, http.MethodOptions)
 }
 
-func handleUSDARequests(router *mux.Router) {
-	router.Handle("/food/search", lib.CorsMiddleware(http.HandlerFunc(SearchFood))).Methods(http.MethodPost, http.MethodOptions)
-	router.Handle("/food/detail", lib.CorsMiddleware(http.HandlerFunc(FoodDetail))).Methods(http.MethodPost, http.MethodOptions)
-	router.Handle("/foods/detail", lib.CorsMiddleware(http.HandlerFunc(FoodsDetail))).Methods(http.MethodPost, http.MethodOptions)
+func (s *server) handleAdminRequests(router *mux.Router) {
+	router.Handle("/admin/repair/nutrition", s.adminMiddleware(http.HandlerFunc(s.RepairNutritionHandler))).Methods(http.MethodPost)
+	router.Handle("/admin/cache/foods", s.adminMiddleware(http.HandlerFunc(s.FoodCacheStatsHandler))).Methods(http.MethodGet)
+	router.Handle("/admin/foods/reindex", s.adminMiddleware(http.HandlerFunc(s.ReindexFoodsHandler))).Methods(http.MethodPost)
 }
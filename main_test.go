@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/refactored-spoon-backend/internal/fdc"
+	"github.com/refactored-spoon-backend/internal/lib"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testMailer records the emails it is asked to send
+type testMailer struct {
+	mu   sync.Mutex
+	sent []testEmail
+}
+
+type testEmail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+func (m *testMailer) Send(to string, subject string, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, testEmail{To: to, Subject: subject, Body: body})
+	return nil
+}
+
+// routeTest is a single request against the full handler and the response it should get
+type routeTest struct {
+	name    string
+	method  string
+	path    string      // {mealId}, {foodId} and {sessionId} are replaced with the IDs created by the test setup
+	body    interface{} // strings are sent as is, anything else is encoded as JSON
+	header  map[string]string
+	noAuth  bool // leave out the bearer token
+	want    int
+	wantErr string // code of the APIError in the response body, if any
+}
+
+// newTestServer returns a server backed by in-memory stores whose USDA requests go nowhere unless foods is changed
+func newTestServer(t *testing.T) (*server, *testMailer) {
+	t.Helper()
+	mailer := &testMailer{}
+	s := newServer(NewMemoryDayStore(), NewMemoryUserStore(), NewMemorySessionStore(), mailer, fdc.NewClient("http://usda.invalid/", "", time.Second))
+	t.Cleanup(s.background.Wait)
+	return s, mailer
+}
+
+// signIn creates a user with a session directly in the stores, skipping the slow password hashing of /signup and /login
+func signIn(t *testing.T, s *server, email string) *loginResponse {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user := User{Email: email}
+	if err := s.users.CreateUser(ctx, &user); err != nil {
+		t.Fatal(err)
+	}
+	session, err := createSession(ctx, s.sessions, httptest.NewRequest(http.MethodPost, "/login", nil), user.ID.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := issueSessionTokens(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// serve sends a request through the full handler, including routing and middleware
+func serve(t *testing.T, h http.Handler, method string, path string, token string, body interface{}, header map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		reader = strings.NewReader(b)
+	default:
+		encoded, err := json.Marshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	r := httptest.NewRequest(method, path, reader)
+	if len(token) > 0 {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	for name, value := range header {
+		r.Header.Set(name, value)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// decodeResponse decodes a JSON response body into v
+func decodeResponse(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+		t.Fatalf("unable to decode response %q: %v", w.Body.String(), err)
+	}
+}
+
+// runRouteTests runs the tests in order since later requests may depend on the changes made by earlier ones
+func runRouteTests(t *testing.T, h http.Handler, token string, ids *strings.Replacer, tests []routeTest) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requestToken := token
+			if tt.noAuth {
+				requestToken = ""
+			}
+
+			w := serve(t, h, tt.method, ids.Replace(tt.path), requestToken, tt.body, tt.header)
+			if w.Code != tt.want {
+				t.Fatalf("%s %s: got status %d, want %d: %s", tt.method, tt.path, w.Code, tt.want, w.Body.String())
+			}
+			if len(w.Header().Get("X-Request-ID")) == 0 {
+				t.Errorf("missing X-Request-ID header")
+			}
+
+			if len(tt.wantErr) == 0 {
+				return
+			}
+			var apiErr lib.APIError
+			decodeResponse(t, w, &apiErr)
+			if apiErr.Code != tt.wantErr {
+				t.Fatalf("got error code %q, want %q: %s", apiErr.Code, tt.wantErr, apiErr.Message)
+			}
+			if apiErr.RequestID != w.Header().Get("X-Request-ID") {
+				t.Errorf("got request ID %q in body, want %q", apiErr.RequestID, w.Header().Get("X-Request-ID"))
+			}
+		})
+	}
+}
+
+func TestDayRoutes(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Handler()
+	login := signIn(t, s, "days@example.com")
+
+	w := serve(t, h, http.MethodPost, "/days/"+testDate+"/meals", login.AccessToken, testMeal("breakfast", 100), nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("unable to create meal: %d: %s", w.Code, w.Body.String())
+	}
+	var meal Meal
+	decodeResponse(t, w, &meal)
+	ids := strings.NewReplacer("{mealId}", meal.ID.Hex(), "{foodId}", meal.Foods[0].ID.Hex())
+
+	day := "/days/" + testDate
+	mealPath := day + "/meals/{mealId}"
+	foodPath := mealPath + "/foods/{foodId}"
+	unknownID := primitive.NewObjectID().Hex()
+	food := testMeal("", 50).Foods[0]
+
+	runRouteTests(t, h, login.AccessToken, ids, []routeTest{
+		{name: "list days without token", method: http.MethodGet, path: "/days", noAuth: true, want: http.StatusUnauthorized, wantErr: lib.CodeUnauthorized},
+		{name: "list days with bad token", method: http.MethodGet, path: "/days", header: map[string]string{"Authorization": "Bearer nope"}, noAuth: true, want: http.StatusUnauthorized, wantErr: lib.CodeUnauthorized},
+		{name: "preflight without token", method: http.MethodOptions, path: "/days", noAuth: true, want: http.StatusOK},
+		{name: "list days", method: http.MethodGet, path: "/days?from=2020-09-01&to=2020-09-30", want: http.StatusOK},
+		{name: "list days with bad from", method: http.MethodGet, path: "/days?from=september", want: http.StatusBadRequest, wantErr: lib.CodeBadRequest},
+		{name: "get day", method: http.MethodGet, path: day, want: http.StatusOK},
+		{name: "get day with legacy date", method: http.MethodGet, path: "/days/010920", want: http.StatusOK},
+		{name: "get missing day", method: http.MethodGet, path: "/days/2020-09-02", want: http.StatusNotFound, wantErr: lib.CodeNotFound},
+		{name: "get day with bad date", method: http.MethodGet, path: "/days/yesterday", want: http.StatusBadRequest, wantErr: lib.CodeBadRequest},
+
+		{name: "list meals", method: http.MethodGet, path: day + "/meals", want: http.StatusOK},
+		{name: "post meal", method: http.MethodPost, path: day + "/meals", body: testMeal("lunch", 200), want: http.StatusCreated},
+		{name: "post meal without name", method: http.MethodPost, path: day + "/meals", body: testMeal("", 200), want: http.StatusUnprocessableEntity, wantErr: lib.CodeValidationFailed},
+		{name: "post malformed meal", method: http.MethodPost, path: day + "/meals", body: `{"name":`, want: http.StatusBadRequest, wantErr: lib.CodeInvalidJSON},
+		{name: "post oversized meal", method: http.MethodPost, path: day + "/meals", body: `{"name":"` + strings.Repeat("a", maxRequestBodyBytes) + `"}`, want: http.StatusRequestEntityTooLarge, wantErr: lib.CodeBodyTooLarge},
+		{name: "get meal", method: http.MethodGet, path: mealPath, want: http.StatusOK},
+		{name: "get unknown meal", method: http.MethodGet, path: day + "/meals/" + unknownID, want: http.StatusNotFound, wantErr: lib.CodeNotFound},
+		{name: "get meal with bad ID", method: http.MethodGet, path: day + "/meals/breakfast", want: http.StatusBadRequest, wantErr: lib.CodeBadRequest},
+
+		{name: "list foods", method: http.MethodGet, path: mealPath + "/foods", want: http.StatusOK},
+		{name: "post food", method: http.MethodPost, path: mealPath + "/foods", body: food, want: http.StatusCreated},
+		{name: "post food without serving", method: http.MethodPost, path: mealPath + "/foods", body: Food{Name: "rice"}, want: http.StatusUnprocessableEntity, wantErr: lib.CodeValidationFailed},
+		{name: "get food", method: http.MethodGet, path: foodPath, want: http.StatusOK},
+		{name: "get unknown food", method: http.MethodGet, path: mealPath + "/foods/" + unknownID, want: http.StatusNotFound, wantErr: lib.CodeNotFound},
+		{name: "update food", method: http.MethodPut, path: foodPath, body: map[string]int{"serving": 150}, want: http.StatusOK},
+		{name: "update food with zero serving", method: http.MethodPut, path: foodPath, body: map[string]int{"serving": 0}, want: http.StatusUnprocessableEntity, wantErr: lib.CodeValidationFailed},
+		{name: "delete food", method: http.MethodDelete, path: foodPath, want: http.StatusNoContent},
+		{name: "get deleted food", method: http.MethodGet, path: foodPath, want: http.StatusNotFound, wantErr: lib.CodeNotFound},
+		{name: "delete foods", method: http.MethodDelete, path: mealPath + "/foods", want: http.StatusNoContent},
+		// updating a meal replaces its foods, so this comes after the food routes
+		{name: "update meal", method: http.MethodPut, path: mealPath, body: testMeal("brunch", 100), want: http.StatusOK},
+		{name: "update meal with stale version", method: http.MethodPut, path: mealPath, body: testMeal("brunch", 100), header: map[string]string{"If-Match": lib.ETag(1)}, want: http.StatusPreconditionFailed, wantErr: lib.CodePreconditionFailed},
+
+		{name: "weekly report", method: http.MethodGet, path: "/reports/weekly?date=" + testDate, want: http.StatusOK},
+		{name: "monthly report", method: http.MethodGet, path: "/reports/monthly?date=" + testDate, want: http.StatusOK},
+		{name: "report with bad date", method: http.MethodGet, path: "/reports/weekly?date=someday", want: http.StatusBadRequest, wantErr: lib.CodeBadRequest},
+		{name: "report without token", method: http.MethodGet, path: "/reports/monthly", noAuth: true, want: http.StatusUnauthorized, wantErr: lib.CodeUnauthorized},
+
+		{name: "delete meal", method: http.MethodDelete, path: mealPath, want: http.StatusNoContent},
+		{name: "delete deleted meal", method: http.MethodDelete, path: mealPath, want: http.StatusNotFound, wantErr: lib.CodeNotFound},
+		{name: "delete meals", method: http.MethodDelete, path: day + "/meals", want: http.StatusNoContent},
+		{name: "delete day", method: http.MethodDelete, path: day, want: http.StatusNoContent},
+		{name: "delete deleted day", method: http.MethodDelete, path: day, want: http.StatusNotFound, wantErr: lib.CodeNotFound},
+
+		{name: "unknown route", method: http.MethodGet, path: "/weeks", want: http.StatusNotFound, wantErr: lib.CodeNotFound},
+		{name: "method not allowed", method: http.MethodPatch, path: day, want: http.StatusMethodNotAllowed, wantErr: lib.CodeMethodNotAllowed},
+	})
+}
+
+func TestDaysAreScopedToUser(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Handler()
+	owner := signIn(t, s, "owner@example.com")
+	other := signIn(t, s, "other@example.com")
+
+	w := serve(t, h, http.MethodPost, "/days/"+testDate+"/meals", owner.AccessToken, testMeal("dinner", 100), nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("unable to create meal: %d: %s", w.Code, w.Body.String())
+	}
+	var meal Meal
+	decodeResponse(t, w, &meal)
+
+	runRouteTests(t, h, other.AccessToken, strings.NewReplacer("{mealId}", meal.ID.Hex()), []routeTest{
+		{name: "get day of other user", method: http.MethodGet, path: "/days/" + testDate, want: http.StatusNotFound, wantErr: lib.CodeNotFound},
+		{name: "get meal of other user", method: http.MethodGet, path: "/days/" + testDate + "/meals/{mealId}", want: http.StatusNotFound, wantErr: lib.CodeNotFound},
+		{name: "delete meal of other user", method: http.MethodDelete, path: "/days/" + testDate + "/meals/{mealId}", want: http.StatusNotFound, wantErr: lib.CodeNotFound},
+	})
+}
+
+func TestUserRoutes(t *testing.T) {
+	s, mailer := newTestServer(t)
+	h := s.Handler()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	credentials := signupRequest{Email: "user@example.com", Password: "correct horse"}
+
+	runRouteTests(t, h, "", strings.NewReplacer(), []routeTest{
+		{name: "signup", method: http.MethodPost, path: "/signup", body: credentials, want: http.StatusCreated},
+		{name: "signup with taken email", method: http.MethodPost, path: "/signup", body: credentials, want: http.StatusConflict, wantErr: lib.CodeConflict},
+		{name: "signup with short password", method: http.MethodPost, path: "/signup", body: signupRequest{Email: "short@example.com", Password: "short"}, want: http.StatusUnprocessableEntity, wantErr: lib.CodeValidationFailed},
+		{name: "signup with password over 72 bytes", method: http.MethodPost, path: "/signup", body: signupRequest{Email: "long@example.com", Password: strings.Repeat("€", 25)}, want: http.StatusUnprocessableEntity, wantErr: lib.CodeValidationFailed},
+		{name: "signup with bad email", method: http.MethodPost, path: "/signup", body: signupRequest{Email: "user", Password: "correct horse"}, want: http.StatusUnprocessableEntity, wantErr: lib.CodeValidationFailed},
+		{name: "login", method: http.MethodPost, path: "/login", body: credentials, want: http.StatusOK},
+		{name: "login with wrong password", method: http.MethodPost, path: "/login", body: userRequest{Email: credentials.Email, Password: "battery staple"}, want: http.StatusUnauthorized, wantErr: lib.CodeUnauthorized},
+		{name: "login with unknown email", method: http.MethodPost, path: "/login", body: userRequest{Email: "nobody@example.com", Password: "correct horse"}, want: http.StatusUnauthorized, wantErr: lib.CodeUnauthorized},
+		{name: "login with malformed body", method: http.MethodPost, path: "/login", body: `[]`, want: http.StatusBadRequest, wantErr: lib.CodeInvalidJSON},
+		{name: "forgot password", method: http.MethodPost, path: "/password/forgot", body: forgotPasswordRequest{Email: credentials.Email}, want: http.StatusAccepted},
+		{name: "forgot password of unknown email", method: http.MethodPost, path: "/password/forgot", body: forgotPasswordRequest{Email: "nobody@example.com"}, want: http.StatusAccepted},
+		{name: "reset password over 72 bytes", method: http.MethodPost, path: "/password/reset", body: resetPasswordRequest{Token: "nope", Password: strings.Repeat("€", 25)}, want: http.StatusUnprocessableEntity, wantErr: lib.CodeValidationFailed},
+		{name: "reset password with bad token", method: http.MethodPost, path: "/password/reset", body: resetPasswordRequest{Token: "nope", Password: "battery staple"}, want: http.StatusBadRequest, wantErr: lib.CodeBadRequest},
+		{name: "verify email with bad token", method: http.MethodPost, path: "/email/verify", body: verifyEmailRequest{Token: "nope"}, want: http.StatusBadRequest, wantErr: lib.CodeBadRequest},
+	})
+
+	// signup and forgot password each sent one email, unknown emails get none
+	s.background.Wait()
+	if len(mailer.sent) != 2 {
+		t.Fatalf("got %d emails, want 2", len(mailer.sent))
+	}
+	verifyToken := emailToken(t, mailer.sent[0])
+	resetToken := emailToken(t, mailer.sent[1])
+
+	runRouteTests(t, h, "", strings.NewReplacer(), []routeTest{
+		{name: "verify email", method: http.MethodPost, path: "/email/verify", body: verifyEmailRequest{Token: verifyToken}, want: http.StatusNoContent},
+		{name: "verify email twice", method: http.MethodPost, path: "/email/verify", body: verifyEmailRequest{Token: verifyToken}, want: http.StatusBadRequest, wantErr: lib.CodeBadRequest},
+		{name: "reset password with verify token", method: http.MethodPost, path: "/password/reset", body: resetPasswordRequest{Token: verifyToken, Password: "battery staple"}, want: http.StatusBadRequest, wantErr: lib.CodeBadRequest},
+		{name: "reset password", method: http.MethodPost, path: "/password/reset", body: resetPasswordRequest{Token: resetToken, Password: "battery staple"}, want: http.StatusNoContent},
+		{name: "login with old password", method: http.MethodPost, path: "/login", body: credentials, want: http.StatusUnauthorized, wantErr: lib.CodeUnauthorized},
+		{name: "login with new password", method: http.MethodPost, path: "/login", body: userRequest{Email: credentials.Email, Password: "battery staple"}, want: http.StatusOK},
+	})
+
+	user, err := s.users.FindUserByEmail(ctx, credentials.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.EmailVerified {
+		t.Errorf("email of user is not verified")
+	}
+}
+
+func TestConcurrentSignups(t *testing.T) {
+	stores := map[string]UserStore{"memory": NewMemoryUserStore()}
+	if len(os.Getenv("DB_CONN_STR")) > 0 {
+		suffix := primitive.NewObjectID().Hex()
+		users, tokens := lib.GetCollection("Users_test_"+suffix), lib.GetCollection("AccountTokens_test_"+suffix)
+		t.Cleanup(func() {
+			users.Drop(context.Background())
+			tokens.Drop(context.Background())
+		})
+		store := NewMongoUserStore(users, tokens)
+		if err := store.EnsureIndexes(context.Background()); err != nil {
+			t.Fatalf("unable to create user indexes: %v", err)
+		}
+		stores["mongo"] = store
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			const signups = 10
+			var wg sync.WaitGroup
+			errs := make(chan error, signups)
+			for i := 0; i < signups; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					errs <- store.CreateUser(ctx, &User{Email: "twice@example.com", Password: "hash"})
+				}()
+			}
+			wg.Wait()
+			close(errs)
+
+			created := 0
+			for err := range errs {
+				switch err {
+				case nil:
+					created++
+				case errUserExists:
+				default:
+					t.Fatal(err)
+				}
+			}
+			if created != 1 {
+				t.Fatalf("created %d users with the same email, want 1", created)
+			}
+		})
+	}
+}
+
+func TestLegacyUsernameRoutes(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Handler()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// accounts from before signup required an email have a username and a plaintext password
+	legacy := User{Email: "jdoe", Password: "hunter22"}
+	if err := s.users.CreateUser(ctx, &legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	runRouteTests(t, h, "", strings.NewReplacer(), []routeTest{
+		{name: "login with username", method: http.MethodPost, path: "/login", body: userRequest{Email: "jdoe", Password: "hunter22"}, want: http.StatusOK},
+		{name: "login with username and wrong password", method: http.MethodPost, path: "/login", body: userRequest{Email: "jdoe", Password: "hunter2"}, want: http.StatusUnauthorized, wantErr: lib.CodeUnauthorized},
+		{name: "login without username", method: http.MethodPost, path: "/login", body: userRequest{Password: "hunter22"}, want: http.StatusUnprocessableEntity, wantErr: lib.CodeValidationFailed},
+		{name: "forgot password of username", method: http.MethodPost, path: "/password/forgot", body: forgotPasswordRequest{Email: "jdoe"}, want: http.StatusAccepted},
+		{name: "signup with username", method: http.MethodPost, path: "/signup", body: signupRequest{Email: "janedoe", Password: "correct horse"}, want: http.StatusUnprocessableEntity, wantErr: lib.CodeValidationFailed},
+	})
+}
+
+// emailToken returns the token in the link of an account email
+func emailToken(t *testing.T, email testEmail) string {
+	t.Helper()
+	i := strings.Index(email.Body, "token=")
+	if i < 0 {
+		t.Fatalf("no token in email %q", email.Body)
+	}
+	return strings.Fields(email.Body[i+len("token="):])[0]
+}
+
+func TestProfileRoutes(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Handler()
+	login := signIn(t, s, "profile@example.com")
+
+	profile := Profile{Sex: "female", BirthDate: "1990-01-01", Height: 170, Weight: 65, ActivityLevel: "moderate", Goal: "maintain"}
+
+	runRouteTests(t, h, login.AccessToken, strings.NewReplacer(), []routeTest{
+		{name: "get empty profile", method: http.MethodGet, path: "/users/me/profile", want: http.StatusOK},
+		{name: "update profile", method: http.MethodPut, path: "/users/me/profile", body: profile, want: http.StatusOK},
+		{name: "update profile with bad goal", method: http.MethodPut, path: "/users/me/profile", body: Profile{Goal: "bulk"}, want: http.StatusUnprocessableEntity, wantErr: lib.CodeValidationFailed},
+		{name: "get profile without token", method: http.MethodGet, path: "/users/me/profile", noAuth: true, want: http.StatusUnauthorized, wantErr: lib.CodeUnauthorized},
+		{name: "get goals", method: http.MethodGet, path: "/users/me/goals", want: http.StatusOK},
+		{name: "update goals", method: http.MethodPut, path: "/users/me/goals", body: NutritionGoals{"protein": {PercentOfCalories: 30}, "fiber": {Value: 30}}, want: http.StatusOK},
+		{name: "update goals without value", method: http.MethodPut, path: "/users/me/goals", body: NutritionGoals{"sugar": {}}, want: http.StatusUnprocessableEntity, wantErr: lib.CodeValidationFailed},
+		{name: "update goals with unknown nutrient", method: http.MethodPut, path: "/users/me/goals", body: NutritionGoals{"caffeine": {Value: 400}}, want: http.StatusUnprocessableEntity, wantErr: lib.CodeValidationFailed},
+		{name: "update goals with malformed body", method: http.MethodPut, path: "/users/me/goals", body: `{"protein": 30}`, want: http.StatusBadRequest, wantErr: lib.CodeInvalidJSON},
+	})
+
+	w := serve(t, h, http.MethodGet, "/users/me/profile", login.AccessToken, nil, nil)
+	var res profileResponse
+	decodeResponse(t, w, &res)
+	if res.Profile != profile {
+		t.Errorf("got profile %+v, want %+v", res.Profile, profile)
+	}
+	if res.Targets == nil {
+		t.Errorf("missing targets for complete profile")
+	}
+}
+
+func TestProfileValidationDetails(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Handler()
+	login := signIn(t, s, "details@example.com")
+
+	tests := []struct {
+		name   string
+		path   string
+		body   interface{}
+		fields []string
+	}{
+		{name: "profile", path: "/users/me/profile", body: Profile{Sex: "other", BirthDate: "2999-01-01", Height: -1, Goal: "bulk"}, fields: []string{"sex", "height", "goal", "birthDate"}},
+		{name: "goals", path: "/users/me/goals", body: NutritionGoals{"caffeine": {Value: 400}, "fiber": {PercentOfCalories: 10}, "protein": {Value: -1}}, fields: []string{"caffeine", "fiber.percentOfCalories", "protein.value"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(t, h, http.MethodPut, tt.path, login.AccessToken, tt.body, nil)
+			if w.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("got status %d, want %d", w.Code, http.StatusUnprocessableEntity)
+			}
+			var res struct {
+				Details lib.ValidationErrors `json:"details"`
+			}
+			decodeResponse(t, w, &res)
+			fields := make([]string, len(res.Details))
+			for i, detail := range res.Details {
+				fields[i] = detail.Field
+			}
+			if strings.Join(fields, ",") != strings.Join(tt.fields, ",") {
+				t.Errorf("got invalid fields %v, want %v", fields, tt.fields)
+			}
+		})
+	}
+}
+
+func TestSessionRoutes(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Handler()
+	login := signIn(t, s, "sessions@example.com")
+	other := signIn(t, s, "other@example.com")
+
+	ids := strings.NewReplacer("{sessionId}", login.SessionID)
+
+	runRouteTests(t, h, login.AccessToken, ids, []routeTest{
+		{name: "list sessions", method: http.MethodGet, path: "/sessions", want: http.StatusOK},
+		{name: "refresh", method: http.MethodPost, path: "/sessions/refresh", body: refreshRequest{RefreshToken: login.RefreshToken}, noAuth: true, want: http.StatusOK},
+		{name: "refresh with used token", method: http.MethodPost, path: "/sessions/refresh", body: refreshRequest{RefreshToken: login.RefreshToken}, noAuth: true, want: http.StatusUnauthorized, wantErr: lib.CodeUnauthorized},
+		{name: "refresh with access token", method: http.MethodPost, path: "/sessions/refresh", body: refreshRequest{RefreshToken: login.AccessToken}, noAuth: true, want: http.StatusUnauthorized, wantErr: lib.CodeUnauthorized},
+		{name: "refresh without token", method: http.MethodPost, path: "/sessions/refresh", body: refreshRequest{}, noAuth: true, want: http.StatusUnprocessableEntity, wantErr: lib.CodeValidationFailed},
+		// reusing a refresh token revoked the whole session
+		{name: "list sessions of revoked session", method: http.MethodGet, path: "/sessions", want: http.StatusUnauthorized, wantErr: lib.CodeUnauthorized},
+	})
+
+	ids = strings.NewReplacer("{sessionId}", other.SessionID)
+
+	runRouteTests(t, h, other.AccessToken, ids, []routeTest{
+		{name: "delete session with bad ID", method: http.MethodDelete, path: "/sessions/current", want: http.StatusBadRequest, wantErr: lib.CodeBadRequest},
+		{name: "delete session of other user", method: http.MethodDelete, path: "/sessions/" + login.SessionID, want: http.StatusNotFound, wantErr: lib.CodeNotFound},
+		{name: "delete all sessions", method: http.MethodDelete, path: "/sessions", want: http.StatusNoContent},
+		{name: "delete session after logging out", method: http.MethodDelete, path: "/sessions/{sessionId}", want: http.StatusUnauthorized, wantErr: lib.CodeUnauthorized},
+	})
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name      string
+		forwarded []string
+		want      string
+	}{
+		{name: "without proxy", want: "192.0.2.1"},
+		{name: "through router", forwarded: []string{"203.0.113.7"}, want: "203.0.113.7"},
+		{name: "with forged entry", forwarded: []string{"10.0.0.1, 203.0.113.7"}, want: "203.0.113.7"},
+		{name: "with forged header", forwarded: []string{"10.0.0.1", "203.0.113.7"}, want: "203.0.113.7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/login", nil)
+			for _, forwarded := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", forwarded)
+			}
+			if got := clientIP(r); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	admin := map[string]string{"X-Admin-Key": "secret"}
+
+	// admin routes are disabled without ADMIN_API_KEY, whatever key is sent
+	t.Setenv("ADMIN_API_KEY", "")
+	disabled, _ := newTestServer(t)
+	runRouteTests(t, disabled.Handler(), "", strings.NewReplacer(), []routeTest{
+		{name: "repair while disabled", method: http.MethodPost, path: "/admin/repair/nutrition", header: admin, want: http.StatusForbidden, wantErr: lib.CodeForbidden},
+	})
+
+	t.Setenv("ADMIN_API_KEY", "secret")
+	s, _ := newTestServer(t)
+	h := s.Handler()
+
+	runRouteTests(t, h, "", strings.NewReplacer(), []routeTest{
+		{name: "repair without key", method: http.MethodPost, path: "/admin/repair/nutrition", want: http.StatusForbidden, wantErr: lib.CodeForbidden},
+		{name: "repair with wrong key", method: http.MethodPost, path: "/admin/repair/nutrition", header: map[string]string{"X-Admin-Key": "guess"}, want: http.StatusForbidden, wantErr: lib.CodeForbidden},
+		{name: "repair", method: http.MethodPost, path: "/admin/repair/nutrition", header: admin, want: http.StatusOK},
+		{name: "repair and fix", method: http.MethodPost, path: "/admin/repair/nutrition?fix=true", header: admin, want: http.StatusOK},
+		{name: "cache stats without cache", method: http.MethodGet, path: "/admin/cache/foods", header: admin, want: http.StatusNotFound, wantErr: lib.CodeNotFound},
+		{name: "reindex without local foods", method: http.MethodPost, path: "/admin/foods/reindex", header: admin, want: http.StatusNotFound, wantErr: lib.CodeNotFound},
+	})
+
+	s.foods = NewCachedFoodSource(s.foods, NewMemoryFoodCacheStore(), 10)
+	runRouteTests(t, h, "", strings.NewReplacer(), []routeTest{
+		{name: "cache stats with wrong key", method: http.MethodGet, path: "/admin/cache/foods", header: map[string]string{"X-Admin-Key": "guess"}, want: http.StatusForbidden, wantErr: lib.CodeForbidden},
+		{name: "cache stats", method: http.MethodGet, path: "/admin/cache/foods", header: admin, want: http.StatusOK},
+	})
+
+	local := NewLocalFoodSource(importTestDataset(t), s.days)
+	s.foods = local
+	runRouteTests(t, h, "", strings.NewReplacer(), []routeTest{
+		{name: "reindex with wrong key", method: http.MethodPost, path: "/admin/foods/reindex", header: map[string]string{"X-Admin-Key": "guess"}, want: http.StatusForbidden, wantErr: lib.CodeForbidden},
+		{name: "reindex", method: http.MethodPost, path: "/admin/foods/reindex", header: admin, want: http.StatusAccepted},
+	})
+
+	// the index is built in the background, searches work once it is done
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		_, err := local.Search(ctx, fdc.FoodSearchCriteria{GeneralSearchInput: "banana", PageNumber: 1, PageSize: 10})
+		if err == nil {
+			break
+		}
+		if err != errFoodIndexLoading || ctx.Err() != nil {
+			t.Fatalf("search after reindexing failed: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
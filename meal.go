@@ -3,83 +3,114 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"net/http"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/refactored-spoon-backend/internal/lib"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
-// MealsHandler handles /meals GET and POST requests
-func MealsHandler(w http.ResponseWriter, r *http.Request) {
+// maxMealUpdateAttempts is how many times a meal update is retried when the meal changes underneath it
+const maxMealUpdateAttempts = 5
+
+var (
+	errMealNotFound = errors.New("could not find meal")
+	errMealConflict = errors.New("meal was modified concurrently, please retry")
+	errMealModified = errors.New("meal has been modified since it was read")
+)
+
+// MealsHandler handles /meals GET, POST and DELETE requests
+func (s *server) MealsHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	date := vars["date"]
+	date, err := normalizeDate(vars["date"])
+	if err != nil {
+		writeDateError(w, r, "date", err)
+		return
+	}
 
-	collection := lib.GetCollection("Days")
-	userID := r.URL.Query().Get("userId")
+	userID := lib.UserIDFromContext(r.Context())
 
 	switch r.Method {
 	case http.MethodGet:
-		getMeals(w, r, collection, userID, date)
+		getMeals(w, r, s.days, userID, date)
 	case http.MethodPost:
-		postMeal(w, r, collection, userID, date)
+		postMeal(w, r, s.days, userID, date)
+	case http.MethodDelete:
+		deleteMeals(w, r, s.days, userID, date)
 	}
 }
 
-// MealHandler handles /meals/{mealId} PUT and DELETE requests
-func MealHandler(w http.ResponseWriter, r *http.Request) {
+// MealHandler handles /meals/{mealId} GET, PUT and DELETE requests
+func (s *server) MealHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	date := vars["date"]
+	date, err := normalizeDate(vars["date"])
+	if err != nil {
+		writeDateError(w, r, "date", err)
+		return
+	}
+
 	mealID := vars["mealId"]
 	mealObjectID, err := primitive.ObjectIDFromHex(mealID)
 	if err != nil {
-		fmt.Println("error: invalid meal ID provided: " + mealID)
+		lib.WriteError(w, r, http.StatusBadRequest, lib.CodeBadRequest, "invalid meal ID provided: "+mealID, nil)
 		return
 	}
 
-	collection := lib.GetCollection("Days")
-	userID := r.URL.Query().Get("userId")
+	userID := lib.UserIDFromContext(r.Context())
 
 	switch r.Method {
+	case http.MethodGet:
+		getMeal(w, r, s.days, userID, date, mealObjectID)
 	case http.MethodDelete:
-		deleteMeal(w, r, collection, userID, date, mealObjectID)
+		deleteMeal(w, r, s.days, userID, date, mealObjectID)
 	case http.MethodPut:
-		updateMeal(w, r, collection, userID, date, mealObjectID)
+		updateMeal(w, r, s.days, userID, date, mealObjectID)
 	}
 }
 
-func getMeals(w http.ResponseWriter, r *http.Request, collection *mongo.Collection, userID string, date string) {
+func getMeals(w http.ResponseWriter, r *http.Request, days DayStore, userID string, date string) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	cur, err := collection.Find(ctx, bson.M{"userId": userID, "date": date})
+	dayRecord, err := days.GetDay(ctx, userID, date)
+	if err == errDayNotFound {
+		lib.WriteError(w, r, http.StatusNotFound, lib.CodeNotFound, err.Error(), nil)
+		return
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("could not find day results:\n" + err.Error()))
+		lib.WriteInternalError(w, r, "could not find day", err)
 		return
 	}
-	defer cur.Close(ctx)
 
-	meals := make([]Meal, 0)
-	for cur.Next(ctx) {
-		var meal Meal
-		err = cur.Decode(&meal)
-		if err != nil {
-			w.Write([]byte(err.Error()))
-			return
-		}
-		meals = append(meals, meal)
+	meals := dayRecord.Meals
+	if meals == nil {
+		meals = make([]Meal, 0)
 	}
+	sortMeals(meals)
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", lib.ETag(dayRecord.Version))
 	json.NewEncoder(w).Encode(meals)
 }
 
-func postMeal(w http.ResponseWriter, r *http.Request, collection *mongo.Collection, userID string, date string) {
+func getMeal(w http.ResponseWriter, r *http.Request, days DayStore, userID string, date string, mealID primitive.ObjectID) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	meal, err := findDayMeal(ctx, days, userID, date, mealID)
+	if err != nil {
+		writeMealError(w, r, "could not find meal", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", lib.ETag(meal.Version))
+	json.NewEncoder(w).Encode(meal)
+}
+
+func postMeal(w http.ResponseWriter, r *http.Request, days DayStore, userID string, date string) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
@@ -87,8 +118,20 @@ func postMeal(w http.ResponseWriter, r *http.Request, collection *mongo.Collecti
 	var meal Meal
 	err := decoder.Decode(&meal)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("could not decode post meal request:\n" + err.Error()))
+		lib.WriteDecodeError(w, r, "could not decode post meal request", err)
+		return
+	}
+
+	err = lib.Validate(meal)
+	if err != nil {
+		lib.WriteValidationError(w, r, err)
+		return
+	}
+
+	// nutrition is always derived from the USDA nutrition and serving of each food
+	err = computeMealNutrition(&meal)
+	if err != nil {
+		writeMealError(w, r, "invalid meal", err)
 		return
 	}
 
@@ -98,49 +141,20 @@ func postMeal(w http.ResponseWriter, r *http.Request, collection *mongo.Collecti
 		meal.Foods[i].ID = primitive.NewObjectID()
 	}
 
-	// get day record or create one if it doesn't exist
-	dayRecord := GetDayByDate(ctx, collection, userID, date)
-	if dayRecord.ID == primitive.NilObjectID {
-		dayRecord = &DayRecord{
-			Date:      date,
-			UserID:    userID,
-			Meals:     []Meal{},
-			Nutrition: NutritionSummary{},
-		}
-		_, err := collection.InsertOne(ctx, dayRecord)
-		if err != nil {
-			fmt.Println("insert dayRecord failed!")
-			fmt.Println(err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("unable to insert into day collection:\n" + err.Error()))
-			return
-		}
-	}
-
-	// add meal nutrition to day record nutrition
-	nutrition := updateNutrition(dayRecord.Nutrition, meal.Nutrition, 1.0)
-
-	// update day record with new meal
-	_, err = collection.UpdateOne(
-		ctx,
-		bson.M{"userId": userID, "date": date},
-		bson.M{
-			"$set":  bson.M{"nutrition": nutrition},
-			"$push": bson.M{"meals": meal},
-		},
-	)
+	// create the day record if it doesn't exist and add the meal to it in a single atomic update
+	err = days.InsertMeal(ctx, userID, date, &meal)
 	if err != nil {
-		fmt.Println("update failed!")
-		fmt.Println(err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("unable to add meal into day collection:\n" + err.Error()))
+		lib.WriteInternalError(w, r, "unable to add meal into day collection", err)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", lib.ETag(meal.Version))
 	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(meal)
 }
 
-func updateMeal(w http.ResponseWriter, r *http.Request, collection *mongo.Collection, userID string, date string, mealID primitive.ObjectID) {
+func updateMeal(w http.ResponseWriter, r *http.Request, days DayStore, userID string, date string, mealID primitive.ObjectID) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
@@ -148,9 +162,20 @@ func updateMeal(w http.ResponseWriter, r *http.Request, collection *mongo.Collec
 	var meal Meal
 	err := decoder.Decode(&meal)
 	if err != nil {
-		fmt.Println("could not decode post meal request:\n" + err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("could not decode post meal request:\n" + err.Error()))
+		lib.WriteDecodeError(w, r, "could not decode update meal request", err)
+		return
+	}
+
+	err = lib.Validate(meal)
+	if err != nil {
+		lib.WriteValidationError(w, r, err)
+		return
+	}
+
+	// nutrition is always derived from the USDA nutrition and serving of each food
+	err = computeMealNutrition(&meal)
+	if err != nil {
+		writeMealError(w, r, "invalid meal", err)
 		return
 	}
 
@@ -161,64 +186,108 @@ func updateMeal(w http.ResponseWriter, r *http.Request, collection *mongo.Collec
 		}
 	}
 
-	dayRecord := GetDayByDate(ctx, collection, userID, date)
-	meals := dayRecord.Meals
+	meal.ID = mealID
 
-	// find original value for meal to be updated
-	var originalMealIdx int
-	for i, _ := range meals {
-		if meals[i].ID == mealID {
-			originalMealIdx = i
-			break
-		}
+	expectedVersions, err := lib.IfMatch(r)
+	if err != nil {
+		lib.WriteError(w, r, http.StatusBadRequest, lib.CodeBadRequest, err.Error(), nil)
+		return
 	}
 
-	// replace original meal's nutrition with the updated meal's nutrition in the total day nutrition
-	nutrition := updateNutrition(dayRecord.Nutrition, meals[originalMealIdx].Nutrition, -1.0) // subtract original nutrition
-	nutrition = updateNutrition(nutrition, meal.Nutrition, 1.0)                               // add new nutrition
+	// replace original meal with new meal, swapping its nutrition in the total day nutrition
+	err = replaceMeal(ctx, days, userID, date, mealID, &meal, expectedVersions)
+	if err != nil {
+		writeMealError(w, r, "unable to update meal in day collection", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", lib.ETag(meal.Version))
+	json.NewEncoder(w).Encode(meal)
+}
 
-	// replace original meal with new meal
-	meals[originalMealIdx] = meal
+func deleteMeal(w http.ResponseWriter, r *http.Request, days DayStore, userID string, date string, mealID primitive.ObjectID) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-	// commit changes to database
-	_, err = collection.UpdateOne(
-		ctx,
-		bson.M{"userId": userID, "date": date},
-		bson.M{
-			"$set": bson.M{"nutrition": nutrition, "meals": meals},
-		},
-	)
+	expectedVersions, err := lib.IfMatch(r)
 	if err != nil {
-		fmt.Println("unable to add meal into day collection:\n" + err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("unable to add meal into day collection:\n" + err.Error()))
+		lib.WriteError(w, r, http.StatusBadRequest, lib.CodeBadRequest, err.Error(), nil)
 		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
+	err = replaceMeal(ctx, days, userID, date, mealID, nil, expectedVersions)
+	if err != nil {
+		writeMealError(w, r, "unable to delete meal from day collection", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func deleteMeal(w http.ResponseWriter, r *http.Request, collection *mongo.Collection, userID string, date string, mealID primitive.ObjectID) {
+// deleteMeals removes every meal of a day and zeroes its nutrition, If-Match is checked against the day version
+func deleteMeals(w http.ResponseWriter, r *http.Request, days DayStore, userID string, date string) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	dayRecord := GetDayByDate(ctx, collection, userID, date)
-	var mealToDelete Meal
-	for _, meal := range dayRecord.Meals {
-		if meal.ID == mealID {
-			mealToDelete = meal
-			break
+	expectedVersions, err := lib.IfMatch(r)
+	if err != nil {
+		lib.WriteError(w, r, http.StatusBadRequest, lib.CodeBadRequest, err.Error(), nil)
+		return
+	}
+
+	err = days.DeleteMeals(ctx, userID, date, expectedVersions)
+	if err != nil {
+		writeDayError(w, r, "unable to delete meals from day collection", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeMealError responds with the status matching an error from reading or changing a meal,
+// message is only used for unexpected errors
+func writeMealError(w http.ResponseWriter, r *http.Request, message string, err error) {
+	var invalidFood *invalidFoodError
+	switch {
+	case err == errDayNotFound, err == errMealNotFound, err == errFoodNotFound:
+		lib.WriteError(w, r, http.StatusNotFound, lib.CodeNotFound, err.Error(), nil)
+	case err == errMealConflict:
+		lib.WriteError(w, r, http.StatusConflict, lib.CodeConflict, err.Error(), nil)
+	case err == errMealModified:
+		lib.WriteError(w, r, http.StatusPreconditionFailed, lib.CodePreconditionFailed, err.Error(), nil)
+	case errors.As(err, &invalidFood):
+		lib.WriteError(w, r, http.StatusUnprocessableEntity, lib.CodeValidationFailed, err.Error(), nil)
+	default:
+		lib.WriteInternalError(w, r, message, err)
+	}
+}
+
+// findDayMeal returns a meal of a day, or errMealNotFound if either the day or the meal doesn't exist
+func findDayMeal(ctx context.Context, days DayStore, userID string, date string, mealID primitive.ObjectID) (*Meal, error) {
+	dayRecord, err := days.GetDay(ctx, userID, date)
+	if err == errDayNotFound {
+		return nil, errMealNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range dayRecord.Meals {
+		if dayRecord.Meals[i].ID == mealID {
+			return &dayRecord.Meals[i], nil
 		}
 	}
+	return nil, errMealNotFound
+}
 
-	collection.UpdateOne(
-		ctx,
-		bson.M{"userId": userID, "date": date, "meals": bson.M{"$elemMatch": bson.M{"_id": mealID}}},
-		bson.M{
-			"$set":  bson.M{"nutrition": updateNutrition(dayRecord.Nutrition, mealToDelete.Nutrition, -1)},
-			"$pull": bson.M{"meals": mealToDelete},
-		},
-	)
+// replaceMeal atomically replaces a meal of a day, or removes it if meal is nil, and adjusts the day nutrition by the difference
+// if expectedVersions is set the meal must be at one of those versions, which is how If-Match is honored
+func replaceMeal(ctx context.Context, days DayStore, userID string, date string, mealID primitive.ObjectID, meal *Meal, expectedVersions []int64) error {
+	_, err := days.MutateMeal(ctx, userID, date, mealID, expectedVersions, func(original Meal) (*Meal, error) {
+		return meal, nil
+	})
+	return err
 }
 
 func updateNutrition(dayNutrition NutritionSummary, mealNutrition NutritionSummary, sign float64) NutritionSummary {
@@ -241,7 +310,6 @@ func updateNutrition(dayNutrition NutritionSummary, mealNutrition NutritionSumma
 }
 
 func updateNutrient(dayNutrient *Nutrient, mealNutrient Nutrient, sign float64) {
-	dayNutrient.NutrientName = mealNutrient.NutrientName
-	dayNutrient.UnitName = mealNutrient.UnitName
-	dayNutrient.Value += sign * mealNutrient.Value
+	mealNutrient.Value *= sign
+	addNutrient(dayNutrient, mealNutrient)
 }
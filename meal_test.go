@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/refactored-spoon-backend/internal/lib"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	testUserID = "5f5a1b2c3d4e5f6a7b8c9d0e"
+	testDate   = "2020-09-01"
+)
+
+// testDayStores returns the stores day tests run against: an in-memory store, and a uniquely named
+// MongoDB days collection that is dropped after the test when DB_CONN_STR is set
+func testDayStores(t *testing.T) map[string]DayStore {
+	stores := map[string]DayStore{"memory": NewMemoryDayStore()}
+	if len(os.Getenv("DB_CONN_STR")) == 0 {
+		t.Log("DB_CONN_STR is not set, skipping MongoDB store")
+		return stores
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	collection := lib.GetCollection("Days_test_" + primitive.NewObjectID().Hex())
+	store := NewMongoDayStore(collection)
+	if err := store.EnsureIndexes(ctx); err != nil {
+		t.Fatalf("unable to create day indexes: %v", err)
+	}
+	t.Cleanup(func() {
+		collection.Drop(context.Background())
+	})
+	stores["mongo"] = store
+	return stores
+}
+
+func testMeal(name string, serving int) Meal {
+	return Meal{
+		Name: name,
+		Foods: []Food{{
+			Name:    "rice",
+			Serving: serving,
+			USDANutrition: &NutritionSummary{
+				Calories: Nutrient{NutrientName: "Energy", UnitName: "KCAL", Value: 130},
+				Protein:  Nutrient{NutrientName: "Protein", UnitName: "G", Value: 2.7},
+			},
+		}},
+	}
+}
+
+func mealRequest(t *testing.T, method string, meal Meal) *http.Request {
+	body, err := json.Marshal(meal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewRequest(method, "/days/"+testDate+"/meals", bytes.NewReader(body))
+}
+
+// assertDayConsistent checks that there is exactly one day document and that its totals match the sum over its meals
+func assertDayConsistent(t *testing.T, store DayStore, wantMeals int, wantCalories float64) *DayRecord {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, count, err := store.ListDays(ctx, testUserID, DayQuery{From: testDate, To: testDate, Page: 1, PageSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("got %d day documents, want 1", count)
+	}
+
+	dayRecord, err := store.GetDay(ctx, testUserID, testDate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dayRecord.Meals) != wantMeals {
+		t.Fatalf("got %d meals, want %d", len(dayRecord.Meals), wantMeals)
+	}
+	if discrepancies := compareNutrition(dayRecord.Nutrition, sumMealNutrition(dayRecord.Meals)); len(discrepancies) > 0 {
+		t.Fatalf("day nutrition drifted from the sum over meals: %+v", discrepancies)
+	}
+	if math.Abs(dayRecord.Nutrition.Calories.Value-wantCalories) > nutrientTolerance {
+		t.Fatalf("got %v calories, want %v", dayRecord.Nutrition.Calories.Value, wantCalories)
+	}
+	return dayRecord
+}
+
+func TestConcurrentMealMutations(t *testing.T) {
+	for name, store := range testDayStores(t) {
+		t.Run(name, func(t *testing.T) {
+			testConcurrentMealMutations(t, store)
+		})
+	}
+}
+
+func testConcurrentMealMutations(t *testing.T, store DayStore) {
+	const mealCount = 20
+
+	// parallel posts to a day that doesn't exist yet must create a single document
+	var wg sync.WaitGroup
+	wantCalories := 0.0
+	for i := 0; i < mealCount; i++ {
+		serving := 10 * (i + 1)
+		wantCalories += 1.3 * float64(serving)
+
+		wg.Add(1)
+		go func(i int, serving int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			postMeal(w, mealRequest(t, http.MethodPost, testMeal("meal", serving)), store, testUserID, testDate)
+			if w.Code != http.StatusCreated {
+				t.Errorf("post meal %d: got status %d: %s", i, w.Code, w.Body.String())
+			}
+		}(i, serving)
+	}
+	wg.Wait()
+	dayRecord := assertDayConsistent(t, store, mealCount, wantCalories)
+
+	// parallel updates doubling every serving
+	for _, meal := range dayRecord.Meals {
+		wg.Add(1)
+		go func(meal Meal) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			updated := testMeal(meal.Name, 2*meal.Foods[0].Serving)
+			updateMeal(w, mealRequest(t, http.MethodPut, updated), store, testUserID, testDate, meal.ID)
+			if w.Code != http.StatusOK {
+				t.Errorf("update meal %s: got status %d: %s", meal.ID.Hex(), w.Code, w.Body.String())
+			}
+		}(meal)
+	}
+	wg.Wait()
+	wantCalories *= 2
+	dayRecord = assertDayConsistent(t, store, mealCount, wantCalories)
+
+	// parallel deletes of half of the meals
+	for _, meal := range dayRecord.Meals[:mealCount/2] {
+		wantCalories -= meal.Nutrition.Calories.Value
+
+		wg.Add(1)
+		go func(meal Meal) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			deleteMeal(w, httptest.NewRequest(http.MethodDelete, "/", nil), store, testUserID, testDate, meal.ID)
+			if w.Code != http.StatusNoContent {
+				t.Errorf("delete meal %s: got status %d: %s", meal.ID.Hex(), w.Code, w.Body.String())
+			}
+		}(meal)
+	}
+	wg.Wait()
+	assertDayConsistent(t, store, mealCount/2, wantCalories)
+}
+
+func TestDeleteMissingMeal(t *testing.T) {
+	for name, store := range testDayStores(t) {
+		t.Run(name, func(t *testing.T) {
+			testDeleteMissingMeal(t, store)
+		})
+	}
+}
+
+func testDeleteMissingMeal(t *testing.T, store DayStore) {
+	w := httptest.NewRecorder()
+	postMeal(w, mealRequest(t, http.MethodPost, testMeal("lunch", 100)), store, testUserID, testDate)
+
+	w = httptest.NewRecorder()
+	deleteMeal(w, httptest.NewRequest(http.MethodDelete, "/", nil), store, testUserID, testDate, primitive.NewObjectID())
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	assertDayConsistent(t, store, 1, 130)
+}
+
+func TestZeroCalorieFood(t *testing.T) {
+	for name, store := range testDayStores(t) {
+		t.Run(name, func(t *testing.T) {
+			testZeroCalorieFood(t, store)
+		})
+	}
+}
+
+func testZeroCalorieFood(t *testing.T, store DayStore) {
+	water := testMeal("water", 250)
+	water.Foods[0].Name = "water"
+	water.Foods[0].USDANutrition = &NutritionSummary{Calories: Nutrient{NutrientName: "Energy", UnitName: "KCAL"}}
+
+	w := httptest.NewRecorder()
+	postMeal(w, mealRequest(t, http.MethodPost, water), store, testUserID, testDate)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusCreated, w.Body.String())
+	}
+	assertDayConsistent(t, store, 1, 0)
+
+	missing := testMeal("snack", 100)
+	missing.Foods[0].USDANutrition = nil
+	w = httptest.NewRecorder()
+	postMeal(w, mealRequest(t, http.MethodPost, missing), store, testUserID, testDate)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusUnprocessableEntity, w.Body.String())
+	}
+	assertDayConsistent(t, store, 1, 0)
+}
+
+func TestUpdateMealIfMatch(t *testing.T) {
+	for name, store := range testDayStores(t) {
+		t.Run(name, func(t *testing.T) {
+			testUpdateMealIfMatch(t, store)
+		})
+	}
+}
+
+func testUpdateMealIfMatch(t *testing.T, store DayStore) {
+	w := httptest.NewRecorder()
+	postMeal(w, mealRequest(t, http.MethodPost, testMeal("dinner", 100)), store, testUserID, testDate)
+	etag := w.Header().Get("ETag")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dayRecord, err := store.GetDay(ctx, testUserID, testDate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mealID := dayRecord.Meals[0].ID
+	// the version after the matching update below
+	updated := lib.ETag(dayRecord.Meals[0].Version + 1)
+
+	tests := []struct {
+		name     string
+		ifMatch  string
+		wantCode int
+	}{
+		{"matching version", etag, http.StatusOK},
+		{"stale version", etag, http.StatusPreconditionFailed},
+		{"list without the current version", etag + `, W/"999"`, http.StatusPreconditionFailed},
+		{"list with the current version", `"999", ` + updated, http.StatusOK},
+		{"malformed list", updated + `, 1`, http.StatusBadRequest},
+		{"malformed", "1", http.StatusBadRequest},
+		{"any version", "*", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := mealRequest(t, http.MethodPut, testMeal("dinner", 200))
+			r.Header.Set("If-Match", tt.ifMatch)
+			w := httptest.NewRecorder()
+			updateMeal(w, r, store, testUserID, testDate, mealID)
+			if w.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestFixDayNutritionVersion(t *testing.T) {
+	for name, store := range testDayStores(t) {
+		t.Run(name, func(t *testing.T) {
+			testFixDayNutritionVersion(t, store)
+		})
+	}
+}
+
+func testFixDayNutritionVersion(t *testing.T, store DayStore) {
+	w := httptest.NewRecorder()
+	postMeal(w, mealRequest(t, http.MethodPost, testMeal("lunch", 100)), store, testUserID, testDate)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	read, err := store.GetDay(ctx, testUserID, testDate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fixed, err := store.FixDayNutrition(ctx, *read, sumMealNutrition(read.Meals))
+	if err != nil || !fixed {
+		t.Fatalf("got fixed %v and error %v, want the day fixed", fixed, err)
+	}
+	dayRecord := assertDayConsistent(t, store, 1, 130)
+	if dayRecord.Version != read.Version+1 {
+		t.Fatalf("got version %d, want %d", dayRecord.Version, read.Version+1)
+	}
+
+	// a client holding the ETag from before the repair must not overwrite it
+	if fixed, err := store.FixDayNutrition(ctx, *read, NutritionSummary{}); err != nil || fixed {
+		t.Fatalf("got fixed %v and error %v for a stale day, want it left alone", fixed, err)
+	}
+	if err := store.DeleteMeals(ctx, testUserID, testDate, []int64{read.Version}); err != errDayModified {
+		t.Fatalf("got error %v deleting meals with a stale version, want %v", err, errDayModified)
+	}
+	assertDayConsistent(t, store, 1, 130)
+}
+
+func TestMergeDuplicateDays(t *testing.T) {
+	if len(os.Getenv("DB_CONN_STR")) == 0 {
+		t.Skip("DB_CONN_STR is not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	collection := lib.GetCollection("Days_test_" + primitive.NewObjectID().Hex())
+	t.Cleanup(func() {
+		collection.Drop(context.Background())
+	})
+	store := NewMongoDayStore(collection)
+
+	// days written before the unique index existed, one of them with a legacy date that migrates onto the others
+	var documents []interface{}
+	for i, date := range []string{testDate, testDate, "010920"} {
+		meal := testMeal("meal", 100*(i+1))
+		meal.ID = primitive.NewObjectID()
+		meal.Version = 1
+		if err := computeMealNutrition(&meal); err != nil {
+			t.Fatal(err)
+		}
+		documents = append(documents, DayRecord{
+			ID:        primitive.NewObjectID(),
+			Date:      date,
+			UserID:    testUserID,
+			Meals:     []Meal{meal},
+			Nutrition: meal.Nutrition,
+			Version:   int64(i + 1),
+		})
+	}
+	if _, err := collection.InsertMany(ctx, documents); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.MigrateDates(ctx); err != nil {
+		t.Fatalf("unable to migrate dates: %v", err)
+	}
+	if err := store.EnsureIndexes(ctx); err != nil {
+		t.Fatalf("unable to create day indexes: %v", err)
+	}
+
+	dayRecord := assertDayConsistent(t, store, 3, 130*6)
+	if dayRecord.Version != 4 {
+		t.Errorf("got version %d, want 4", dayRecord.Version)
+	}
+
+	// with the unique index in place, a legacy day migrating onto an existing one is merged straight away
+	legacy := DayRecord{ID: primitive.NewObjectID(), Date: "010920", UserID: testUserID, Meals: []Meal{testMeal("late", 100)}, Version: 1}
+	legacy.Meals[0].ID = primitive.NewObjectID()
+	if err := computeMealNutrition(&legacy.Meals[0]); err != nil {
+		t.Fatal(err)
+	}
+	legacy.Nutrition = legacy.Meals[0].Nutrition
+	if _, err := collection.InsertOne(ctx, legacy); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.MigrateDates(ctx); err != nil {
+		t.Fatalf("unable to migrate dates: %v", err)
+	}
+	assertDayConsistent(t, store, 4, 130*7)
+}
+
+func TestMemoryDayStoreCopiesMeals(t *testing.T) {
+	store := NewMemoryDayStore()
+	ctx := context.Background()
+
+	meal := testMeal("lunch", 100)
+	if err := store.InsertMeal(ctx, testUserID, testDate, &meal); err != nil {
+		t.Fatal(err)
+	}
+	meal.Foods[0].USDANutrition.Calories.Value = 1
+
+	dayRecord, err := store.GetDay(ctx, testUserID, testDate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dayRecord.Meals[0].Foods[0].USDANutrition.Calories.Value = 2
+
+	dayRecord, err = store.GetDay(ctx, testUserID, testDate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calories := dayRecord.Meals[0].Foods[0].USDANutrition.Calories.Value; calories != 130 {
+		t.Errorf("got %v stored calories per 100 g, want 130 after callers changed their copies", calories)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"math"
+)
+
+// invalidFoodError is returned when the nutrition of a food cannot be computed from what the client sent
+type invalidFoodError struct {
+	message string
+}
+
+func (e *invalidFoodError) Error() string {
+	return e.message
+}
+
+// computeMealNutrition overwrites the nutrition of every food in the meal with its USDA nutrition scaled to its serving,
+// and the nutrition of the meal with the sum over its foods, so that totals sent by clients are never trusted
+func computeMealNutrition(meal *Meal) error {
+	for i := range meal.Foods {
+		if err := computeFoodNutrition(&meal.Foods[i]); err != nil {
+			return err
+		}
+	}
+
+	meal.Nutrition = sumFoodNutrition(meal.Foods)
+	return nil
+}
+
+// sumFoodNutrition returns the sum of the nutrition of the given foods
+func sumFoodNutrition(foods []Food) NutritionSummary {
+	var total NutritionSummary
+	totalFields := total.fields()
+	for _, food := range foods {
+		for name, nutrient := range food.Nutrition.fields() {
+			addNutrient(totalFields[name], *nutrient)
+		}
+	}
+	return total
+}
+
+// computeFoodNutrition sets the nutrition of a food from its per 100 g USDA nutrition and its serving in grams,
+// which request validation already requires to be positive
+func computeFoodNutrition(food *Food) error {
+	// all zero nutrition is valid, e.g. for water or black coffee, so only a missing one is rejected
+	if food.USDANutrition == nil {
+		return &invalidFoodError{"food " + food.Name + " is missing usdaNutrition"}
+	}
+
+	food.Nutrition = scaleNutrition(*food.USDANutrition, float64(food.Serving))
+	return nil
+}
+
+// scaleNutrition returns per 100 g nutrition scaled to the given number of grams
+func scaleNutrition(per100g NutritionSummary, grams float64) NutritionSummary {
+	scaled := per100g
+	for _, nutrient := range scaled.fields() {
+		nutrient.Value = roundNutrient(nutrient.Value * grams / 100)
+	}
+	return scaled
+}
+
+// addNutrient adds a nutrient value to a total, keeping the name and unit of whichever has them
+func addNutrient(total *Nutrient, nutrient Nutrient) {
+	if len(nutrient.NutrientName) > 0 {
+		total.NutrientName = nutrient.NutrientName
+	}
+	if len(nutrient.UnitName) > 0 {
+		total.UnitName = nutrient.UnitName
+	}
+	total.Value = roundNutrient(total.Value + nutrient.Value)
+}
+
+// roundNutrient rounds away floating point noise so that repeated adds and subtracts cancel out
+func roundNutrient(value float64) float64 {
+	return math.Round(value*1000) / 1000
+}
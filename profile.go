@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/refactored-spoon-backend/internal/lib"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// minimumCalorieTarget keeps weight loss targets from dropping to unsafe levels
+	minimumCalorieTarget = 1200.0
+
+	// calorie adjustment applied to TDEE for each goal
+	loseCalorieAdjustment = -500.0
+	gainCalorieAdjustment = 300.0
+
+	// protein target in grams per kg of body weight, higher while losing weight to preserve muscle
+	proteinPerKg         = 1.6
+	proteinPerKgLoseGoal = 2.0
+
+	// share of calories coming from fat, carbs make up the rest
+	fatCalorieShare = 0.25
+
+	caloriesPerGramProtein = 4.0
+	caloriesPerGramCarbs   = 4.0
+	caloriesPerGramFat     = 9.0
+)
+
+// activity multipliers applied to BMR to get TDEE
+var activityMultipliers = map[string]float64{
+	"sedentary":  1.2,
+	"light":      1.375,
+	"moderate":   1.55,
+	"active":     1.725,
+	"veryActive": 1.9,
+}
+
+var goals = map[string]float64{
+	"lose":     loseCalorieAdjustment,
+	"maintain": 0,
+	"gain":     gainCalorieAdjustment,
+}
+
+var errProfileIncomplete = errors.New("profile is missing body metrics needed to compute targets")
+
+// Profile contains the body metrics and goal of a user
+type Profile struct {
+	Sex           string  `json:"sex,omitempty" bson:"sex,omitempty" validate:"oneof=male female"`
+	BirthDate     string  `json:"birthDate,omitempty" bson:"birthDate,omitempty" validate:"date"`    // YYYY-MM-DD, in the past
+	Height        float64 `json:"height,omitempty" bson:"height,omitempty" validate:"min=0,max=300"` // cm
+	Weight        float64 `json:"weight,omitempty" bson:"weight,omitempty" validate:"min=0,max=700"` // kg
+	ActivityLevel string  `json:"activityLevel,omitempty" bson:"activityLevel,omitempty" validate:"oneof=sedentary light moderate active veryActive"`
+	Goal          string  `json:"goal,omitempty" bson:"goal,omitempty" validate:"oneof=lose maintain gain"`
+}
+
+// EnergyTargets are the daily targets derived from a profile
+type EnergyTargets struct {
+	BMR       float64          `json:"bmr"`  // basal metabolic rate in kcal, Mifflin-St Jeor
+	TDEE      float64          `json:"tdee"` // total daily energy expenditure in kcal
+	Nutrition NutritionSummary `json:"nutrition"`
+}
+
+// profileResponse is the body of GET and PUT /users/me/profile
+type profileResponse struct {
+	Profile Profile        `json:"profile"`
+	Targets *EnergyTargets `json:"targets,omitempty"` // omitted until the profile is complete
+}
+
+// ProfileHandler handles /users/me/profile GET and PUT requests
+func (s *server) ProfileHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(lib.UserIDFromContext(r.Context()))
+	if err != nil {
+		lib.WriteError(w, r, http.StatusUnauthorized, lib.CodeUnauthorized, "invalid user ID in token", nil)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		getProfile(w, r, s.users, userID)
+	case http.MethodPut:
+		updateProfile(w, r, s.users, userID)
+	}
+}
+
+func getProfile(w http.ResponseWriter, r *http.Request, users UserStore, userID primitive.ObjectID) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	profile, err := GetProfile(ctx, users, userID)
+	if err != nil {
+		lib.WriteInternalError(w, r, "could not find profile", err)
+		return
+	}
+
+	writeProfile(w, profile)
+}
+
+func updateProfile(w http.ResponseWriter, r *http.Request, users UserStore, userID primitive.ObjectID) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	decoder := json.NewDecoder(r.Body)
+	var profile Profile
+	err := decoder.Decode(&profile)
+	if err != nil {
+		lib.WriteDecodeError(w, r, "could not decode profile request", err)
+		return
+	}
+
+	if err := validateProfile(profile, time.Now()); err != nil {
+		lib.WriteValidationError(w, r, err)
+		return
+	}
+
+	err = users.SetProfile(ctx, userID, profile)
+	if err == errUserNotFound {
+		lib.WriteError(w, r, http.StatusNotFound, lib.CodeNotFound, err.Error(), nil)
+		return
+	}
+	if err != nil {
+		lib.WriteInternalError(w, r, "unable to update profile", err)
+		return
+	}
+
+	writeProfile(w, &profile)
+}
+
+func writeProfile(w http.ResponseWriter, profile *Profile) {
+	res := profileResponse{Profile: *profile}
+	if targets, err := ComputeTargets(profile, time.Now()); err == nil {
+		res.Targets = targets
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// GetProfile returns the profile of a user, which is empty if the user has not set one
+func GetProfile(ctx context.Context, users UserStore, userID primitive.ObjectID) (*Profile, error) {
+	user, err := users.GetUser(ctx, userID)
+	if err == errUserNotFound {
+		return &Profile{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user.Profile, nil
+}
+
+// ComputeTargets derives BMR, TDEE and default daily calorie and macro targets from a profile
+func ComputeTargets(profile *Profile, now time.Time) (*EnergyTargets, error) {
+	multiplier, ok := activityMultipliers[profile.ActivityLevel]
+	if !ok || profile.Weight <= 0 || profile.Height <= 0 {
+		return nil, errProfileIncomplete
+	}
+
+	birthDate, err := time.Parse("2006-01-02", profile.BirthDate)
+	if err != nil {
+		return nil, errProfileIncomplete
+	}
+
+	// Mifflin-St Jeor: 10 * weight(kg) + 6.25 * height(cm) - 5 * age(y) + s, where s is +5 for males and -161 for females
+	bmr := 10*profile.Weight + 6.25*profile.Height - 5*float64(age(birthDate, now))
+	switch profile.Sex {
+	case "male":
+		bmr += 5
+	case "female":
+		bmr -= 161
+	default:
+		return nil, errProfileIncomplete
+	}
+
+	tdee := bmr * multiplier
+	calories := math.Max(tdee+goals[profile.Goal], minimumCalorieTarget)
+
+	protein := profile.Weight * proteinPerKg
+	if profile.Goal == "lose" {
+		protein = profile.Weight * proteinPerKgLoseGoal
+	}
+	fat := calories * fatCalorieShare / caloriesPerGramFat
+	carbs := math.Max((calories-protein*caloriesPerGramProtein-fat*caloriesPerGramFat)/caloriesPerGramCarbs, 0)
+
+	return &EnergyTargets{
+		BMR:  math.Round(bmr),
+		TDEE: math.Round(tdee),
+		Nutrition: NutritionSummary{
+			Calories: Nutrient{NutrientName: "Energy", UnitName: "KCAL", Value: math.Round(calories)},
+			Protein:  Nutrient{NutrientName: "Protein", UnitName: "G", Value: math.Round(protein)},
+			Carbs:    Nutrient{NutrientName: "Carbohydrate, by difference", UnitName: "G", Value: math.Round(carbs)},
+			Fat:      Nutrient{NutrientName: "Total lipid (fat)", UnitName: "G", Value: math.Round(fat)},
+		},
+	}, nil
+}
+
+// validateProfile checks the validate tags of a profile and that its birth date is not after now,
+// returning lib.ValidationErrors
+func validateProfile(profile Profile, now time.Time) error {
+	errs, _ := lib.Validate(profile).(lib.ValidationErrors)
+	if birthDate, err := time.Parse("2006-01-02", profile.BirthDate); err == nil && birthDate.After(now) {
+		errs = append(errs, lib.FieldError{Field: "birthDate", Message: "must be in the past"})
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func age(birthDate time.Time, now time.Time) int {
+	years := now.Year() - birthDate.Year()
+	if now.Month() < birthDate.Month() || (now.Month() == birthDate.Month() && now.Day() < birthDate.Day()) {
+		years--
+	}
+	return years
+}
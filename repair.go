@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/refactored-spoon-backend/internal/lib"
+)
+
+// nutrientTolerance is how far a stored total may drift from the recomputed one before it counts as a discrepancy
+const nutrientTolerance = 0.01
+
+// NutrientDiscrepancy is a nutrient whose stored day total differs from the sum over the day's meals
+type NutrientDiscrepancy struct {
+	Stored   float64 `json:"stored"`
+	Computed float64 `json:"computed"`
+}
+
+// DayDiscrepancy lists the nutrients of a day whose stored totals are wrong
+type DayDiscrepancy struct {
+	DayID     string                         `json:"dayId"`
+	UserID    string                         `json:"userId"`
+	Date      string                         `json:"date"`
+	Nutrients map[string]NutrientDiscrepancy `json:"nutrients"`
+	Fixed     bool                           `json:"fixed"`
+}
+
+// RepairReport is the result of checking the nutrition totals of days
+type RepairReport struct {
+	CheckedDays   int              `json:"checkedDays"`
+	FixedDays     int              `json:"fixedDays"`
+	Discrepancies []DayDiscrepancy `json:"discrepancies"`
+}
+
+// RepairNutritionHandler handles /admin/repair/nutrition POST requests
+// userId limits the check to a single user, fix=true overwrites wrong totals
+func (s *server) RepairNutritionHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	query := r.URL.Query()
+	report, err := RepairNutrition(ctx, s.days, query.Get("userId"), query.Get("fix") == "true")
+	if err != nil {
+		lib.WriteInternalError(w, r, "unable to check nutrition totals", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// runRepairNutrition is the repair-nutrition CLI subcommand
+func runRepairNutrition(args []string) int {
+	flags := flag.NewFlagSet("repair-nutrition", flag.ExitOnError)
+	userID := flags.String("user", "", "only check the days of this user ID")
+	fix := flags.Bool("fix", false, "overwrite stored totals that differ from the sum over meals")
+	timeout := flags.Duration("timeout", 10*time.Minute, "give up after this long")
+	flags.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	defer lib.Disconnect(context.Background())
+
+	report, err := RepairNutrition(ctx, NewMongoDayStore(lib.GetCollection("Days")), *userID, *fix)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "unable to check nutrition totals: "+err.Error())
+		return 1
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+	return 0
+}
+
+// RepairNutrition recomputes the nutrition total of every day of a user, or of all users if userID is empty,
+// from the nutrition of its meals and reports the days where the stored total has drifted, fixing them if fix is set
+func RepairNutrition(ctx context.Context, days DayStore, userID string, fix bool) (*RepairReport, error) {
+	report := &RepairReport{Discrepancies: make([]DayDiscrepancy, 0)}
+	err := days.EachDay(ctx, userID, func(dayRecord DayRecord) error {
+		report.CheckedDays++
+
+		computed := sumMealNutrition(dayRecord.Meals)
+		discrepancy := compareNutrition(dayRecord.Nutrition, computed)
+		if len(discrepancy) == 0 {
+			return nil
+		}
+
+		day := DayDiscrepancy{
+			DayID:     dayRecord.ID.Hex(),
+			UserID:    dayRecord.UserID,
+			Date:      dayRecord.Date,
+			Nutrients: discrepancy,
+		}
+
+		if fix {
+			// only overwrite if the day has not changed since it was read
+			fixed, err := days.FixDayNutrition(ctx, dayRecord, computed)
+			if err != nil {
+				return err
+			}
+			day.Fixed = fixed
+			if fixed {
+				report.FixedDays++
+			}
+		}
+
+		report.Discrepancies = append(report.Discrepancies, day)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func sumMealNutrition(meals []Meal) NutritionSummary {
+	var total NutritionSummary
+	for _, meal := range meals {
+		total = updateNutrition(total, meal.Nutrition, 1.0)
+	}
+	return total
+}
+
+func compareNutrition(stored NutritionSummary, computed NutritionSummary) map[string]NutrientDiscrepancy {
+	discrepancies := make(map[string]NutrientDiscrepancy)
+	computedFields := computed.fields()
+	for name, nutrient := range stored.fields() {
+		if math.Abs(nutrient.Value-computedFields[name].Value) > nutrientTolerance {
+			discrepancies[name] = NutrientDiscrepancy{Stored: nutrient.Value, Computed: computedFields[name].Value}
+		}
+	}
+	return discrepancies
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/refactored-spoon-backend/internal/lib"
+)
+
+// DayValue is the amount of a nutrient consumed on a single day
+type DayValue struct {
+	Date  string  `json:"date" bson:"date"`
+	Value float64 `json:"value" bson:"value"`
+}
+
+// NutrientStats summarizes a single nutrient over the logged days of a report period
+type NutrientStats struct {
+	UnitName string   `json:"unitName"`
+	Total    float64  `json:"total"`
+	Average  float64  `json:"average"` // per logged day
+	Min      DayValue `json:"min"`
+	Max      DayValue `json:"max"`
+}
+
+// NutritionReport is the body of GET /reports/weekly and GET /reports/monthly
+type NutritionReport struct {
+	Period     string                   `json:"period"` // weekly or monthly
+	From       string                   `json:"from"`
+	To         string                   `json:"to"`
+	Days       int                      `json:"days"`       // number of days in the period
+	LoggedDays int                      `json:"loggedDays"` // number of days in the period with a day record
+	Nutrients  map[string]NutrientStats `json:"nutrients"`
+}
+
+// WeeklyReportHandler handles /reports/weekly GET requests for the Monday to Sunday week containing the date query parameter
+func (s *server) WeeklyReportHandler(w http.ResponseWriter, r *http.Request) {
+	date, err := reportDate(r.URL.Query().Get("date"))
+	if err != nil {
+		lib.WriteError(w, r, http.StatusBadRequest, lib.CodeBadRequest, err.Error(), nil)
+		return
+	}
+
+	// time.Weekday starts on Sunday, shift so that weeks start on Monday
+	from := date.AddDate(0, 0, -((int(date.Weekday()) + 6) % 7))
+	to := from.AddDate(0, 0, 6)
+
+	getReport(w, r, s.days, lib.UserIDFromContext(r.Context()), "weekly", from, to)
+}
+
+// MonthlyReportHandler handles /reports/monthly GET requests for the calendar month containing the date query parameter
+func (s *server) MonthlyReportHandler(w http.ResponseWriter, r *http.Request) {
+	date, err := reportDate(r.URL.Query().Get("date"))
+	if err != nil {
+		lib.WriteError(w, r, http.StatusBadRequest, lib.CodeBadRequest, err.Error(), nil)
+		return
+	}
+
+	from := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, -1)
+
+	getReport(w, r, s.days, lib.UserIDFromContext(r.Context()), "monthly", from, to)
+}
+
+func getReport(w http.ResponseWriter, r *http.Request, days DayStore, userID string, period string, from time.Time, to time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	report, err := days.AggregateNutrition(ctx, userID, from.Format(dateLayout), to.Format(dateLayout))
+	if err != nil {
+		lib.WriteInternalError(w, r, "unable to aggregate nutrition report", err)
+		return
+	}
+
+	report.Period = period
+	report.Days = int(to.Sub(from).Hours()/24) + 1
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// reportDate parses the date a report is based on, defaulting to today
+func reportDate(date string) (time.Time, error) {
+	if len(date) == 0 {
+		now := time.Now().UTC()
+		return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC), nil
+	}
+
+	normalized, err := normalizeDate(date)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(dateLayout, normalized)
+}
+
+func roundTenth(value float64) float64 {
+	return math.Round(value*10) / 10
+}
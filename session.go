@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/refactored-spoon-backend/internal/lib"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Session is a single login of a user on a device, every token issued to that login carries its ID
+type Session struct {
+	ID        primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	UserID    string             `json:"-" bson:"userId"`
+	UserAgent string             `json:"userAgent" bson:"userAgent"`
+	IP        string             `json:"ip" bson:"ip"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+	LastSeen  time.Time          `json:"lastSeen" bson:"lastSeen"`
+	ExpiresAt time.Time          `json:"expiresAt" bson:"expiresAt"`
+	RefreshID string             `json:"-" bson:"refreshId"` // jti of the only refresh token currently accepted for this session
+	Revoked   bool               `json:"-" bson:"revoked"`
+	Current   bool               `json:"current" bson:"-"` // whether this is the session making the request
+}
+
+// refreshRequest is the body for POST /sessions/refresh
+type refreshRequest struct {
+	RefreshToken string `json:"refreshToken,omitempty" validate:"required"`
+}
+
+// SessionsHandler handles /sessions GET and DELETE requests, DELETE logs the user out everywhere
+func (s *server) SessionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := lib.UserIDFromContext(r.Context())
+
+	switch r.Method {
+	case http.MethodGet:
+		getSessions(w, r, s.sessions, userID)
+	case http.MethodDelete:
+		deleteSessions(w, r, s.sessions, userID)
+	}
+}
+
+// SessionHandler handles /sessions/{sessionId} DELETE requests
+func (s *server) SessionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sessionID, err := primitive.ObjectIDFromHex(vars["sessionId"])
+	if err != nil {
+		lib.WriteError(w, r, http.StatusBadRequest, lib.CodeBadRequest, "invalid session ID provided: "+vars["sessionId"], nil)
+		return
+	}
+
+	userID := lib.UserIDFromContext(r.Context())
+
+	switch r.Method {
+	case http.MethodDelete:
+		deleteSession(w, r, s.sessions, userID, sessionID)
+	}
+}
+
+// RefreshSession exchanges a refresh token for a new access token and a new refresh token
+// each refresh token can only be used once, reusing an old one revokes the whole session
+func (s *server) RefreshSession(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var refreshReq refreshRequest
+	err := decoder.Decode(&refreshReq)
+	if err != nil {
+		lib.WriteDecodeError(w, r, "could not decode refresh request", err)
+		return
+	}
+
+	err = lib.Validate(refreshReq)
+	if err != nil {
+		lib.WriteValidationError(w, r, err)
+		return
+	}
+
+	claims, err := lib.ParseToken(refreshReq.RefreshToken, lib.RefreshToken)
+	if err != nil {
+		lib.WriteError(w, r, http.StatusUnauthorized, lib.CodeUnauthorized, err.Error(), nil)
+		return
+	}
+
+	sessionID, err := primitive.ObjectIDFromHex(claims.SessionID)
+	if err != nil {
+		lib.WriteError(w, r, http.StatusUnauthorized, lib.CodeUnauthorized, lib.ErrInvalidToken.Error(), nil)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	refreshID, err := lib.NewTokenID()
+	if err != nil {
+		lib.WriteInternalError(w, r, "unable to generate refresh token ID", err)
+		return
+	}
+
+	session, err := s.sessions.RefreshSession(ctx, sessionID, claims.Subject, claims.ID, refreshID, r.UserAgent(), clientIP(r))
+	if err == errSessionNotFound {
+		// either the session is gone or this refresh token was already used, in which case it may have been stolen
+		s.sessions.RevokeSession(ctx, sessionID, claims.Subject)
+		lib.WriteError(w, r, http.StatusUnauthorized, lib.CodeUnauthorized, lib.ErrSessionInactive.Error(), nil)
+		return
+	}
+	if err != nil {
+		lib.WriteInternalError(w, r, "unable to refresh session", err)
+		return
+	}
+
+	res, err := issueSessionTokens(session)
+	if err != nil {
+		lib.WriteInternalError(w, r, "unable to issue tokens", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func getSessions(w http.ResponseWriter, r *http.Request, sessions SessionStore, userID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	active, err := sessions.ListSessions(ctx, userID)
+	if err != nil {
+		lib.WriteInternalError(w, r, "could not find sessions", err)
+		return
+	}
+
+	currentSessionID := lib.SessionIDFromContext(r.Context())
+	for i := range active {
+		active[i].Current = active[i].ID.Hex() == currentSessionID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(active)
+}
+
+func deleteSessions(w http.ResponseWriter, r *http.Request, sessions SessionStore, userID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := sessions.RevokeSessions(ctx, userID)
+	if err != nil {
+		lib.WriteInternalError(w, r, "unable to revoke sessions", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func deleteSession(w http.ResponseWriter, r *http.Request, sessions SessionStore, userID string, sessionID primitive.ObjectID) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := sessions.RevokeSession(ctx, sessionID, userID)
+	if err == errSessionNotFound {
+		lib.WriteError(w, r, http.StatusNotFound, lib.CodeNotFound, "could not find session with ID: "+sessionID.Hex(), nil)
+		return
+	}
+	if err != nil {
+		lib.WriteInternalError(w, r, "unable to revoke session", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// createSession records a new login of the user from the device making the request
+func createSession(ctx context.Context, sessions SessionStore, r *http.Request, userID string) (*Session, error) {
+	refreshID, err := lib.NewTokenID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := &Session{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
+		CreatedAt: now,
+		LastSeen:  now,
+		ExpiresAt: now.Add(lib.RefreshTokenTTL),
+		RefreshID: refreshID,
+	}
+
+	err = sessions.CreateSession(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// checkSession verifies that the session of an access token is still active and records when it was last seen
+func (s *server) checkSession(ctx context.Context, claims *lib.TokenClaims) error {
+	sessionID, err := primitive.ObjectIDFromHex(claims.SessionID)
+	if err != nil {
+		return lib.ErrInvalidToken
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	return s.sessions.TouchSession(ctx, sessionID, claims.Subject)
+}
+
+// issueSessionTokens issues a new access token and a refresh token matching the session's current refresh ID
+func issueSessionTokens(session *Session) (*loginResponse, error) {
+	claims := lib.TokenClaims{
+		Subject:   session.UserID,
+		SessionID: session.ID.Hex(),
+		Type:      lib.AccessToken,
+	}
+	accessToken, err := lib.IssueToken(claims, lib.AccessTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	claims.ID = session.RefreshID
+	claims.Type = lib.RefreshToken
+	refreshToken, err := lib.IssueToken(claims, lib.RefreshTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &loginResponse{
+		UserID:       session.UserID,
+		SessionID:    session.ID.Hex(),
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(lib.AccessTokenTTL.Seconds()),
+	}, nil
+}
+
+// clientIP returns the address of the client, preferring the last X-Forwarded-For entry, which the Heroku router
+// appends, since the entries before it come from the client and can be forged
+func clientIP(r *http.Request) string {
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		entries := strings.Split(forwarded[len(forwarded)-1], ",")
+		if last := strings.TrimSpace(entries[len(entries)-1]); len(last) > 0 {
+			return last
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
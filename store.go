@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/refactored-spoon-backend/internal/fdc"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	errDayModified     = errors.New("day has been modified since it was read")
+	errUserNotFound    = errors.New("could not find user")
+	errUserExists      = errors.New("user with this username already exists!")
+	errSessionNotFound = errors.New("could not find session")
+	errCacheMiss       = errors.New("not in cache")
+)
+
+// DayQuery selects a page of the days of a user between two YYYY-MM-DD dates inclusive, oldest first
+type DayQuery struct {
+	From     string
+	To       string
+	Page     int // starting at 1
+	PageSize int
+	Summary  bool // leave out the meals of each day
+	// only read the fdcId and name of the foods of each day, and the date, for callers that look at what was eaten
+	FoodsOnly bool
+}
+
+// DayStore persists the days of users together with their meals and foods
+// every change to a day increments its version and the day nutrition is kept equal to the sum over its meals
+type DayStore interface {
+	// GetDay returns the day of a user, or errDayNotFound if the user has not logged anything on that date
+	GetDay(ctx context.Context, userID string, date string) (*DayRecord, error)
+	// ListDays returns a page of days and the number of days matching the query across all pages
+	ListDays(ctx context.Context, userID string, query DayQuery) ([]DayRecord, int64, error)
+	// DeleteDay removes a day, if expectedVersions is set the day must be at one of those versions or errDayModified is returned
+	DeleteDay(ctx context.Context, userID string, date string, expectedVersions []int64) error
+
+	// InsertMeal adds a meal at version 1 to a day, creating the day if it doesn't exist yet
+	InsertMeal(ctx context.Context, userID string, date string, meal *Meal) error
+	// MutateMeal atomically replaces a meal with the result of mutate, or removes it if mutate returns nil,
+	// and adjusts the day nutrition by the difference
+	// if expectedVersions is set the meal must be at one of those versions or errMealModified is returned
+	MutateMeal(ctx context.Context, userID string, date string, mealID primitive.ObjectID, expectedVersions []int64, mutate func(original Meal) (*Meal, error)) (*Meal, error)
+	// DeleteMeals removes every meal of a day and zeroes its nutrition
+	// if expectedVersions is set the day must be at one of those versions or errDayModified is returned
+	DeleteMeals(ctx context.Context, userID string, date string, expectedVersions []int64) error
+
+	// AggregateNutrition computes totals, averages and min/max days of every nutrient between two dates inclusive
+	AggregateNutrition(ctx context.Context, userID string, from string, to string) (*NutritionReport, error)
+	// EachDay calls fn with every day of a user, or of all users if userID is empty, stopping at the first error
+	EachDay(ctx context.Context, userID string, fn func(dayRecord DayRecord) error) error
+	// FixDayNutrition overwrites the nutrition of a day and bumps its version as long as it is unchanged since it was read, reporting whether it was
+	FixDayNutrition(ctx context.Context, dayRecord DayRecord, nutrition NutritionSummary) (bool, error)
+}
+
+// UserStore persists user accounts, their profile and goals, and the single-use tokens emailed to them
+type UserStore interface {
+	// CreateUser stores a new user and sets its ID, or returns errUserExists if the email is taken
+	CreateUser(ctx context.Context, user *User) error
+	// GetUser returns a user by ID, or errUserNotFound
+	GetUser(ctx context.Context, userID primitive.ObjectID) (*User, error)
+	// FindUserByEmail returns a user by email, or errUserNotFound
+	FindUserByEmail(ctx context.Context, email string) (*User, error)
+	// UpdatePassword replaces the stored password hash of a user
+	UpdatePassword(ctx context.Context, userID primitive.ObjectID, passwordHash string) error
+	// SetEmailVerified marks the email of a user as verified
+	SetEmailVerified(ctx context.Context, userID primitive.ObjectID) error
+	// SetProfile replaces the profile of a user, or returns errUserNotFound
+	SetProfile(ctx context.Context, userID primitive.ObjectID, profile Profile) error
+	// SetGoals replaces the nutrition goals of a user, or returns errUserNotFound
+	SetGoals(ctx context.Context, userID primitive.ObjectID, goals NutritionGoals) error
+
+	// CreateAccountToken stores a single-use token
+	CreateAccountToken(ctx context.Context, token accountToken) error
+	// UseAccountToken marks the unused, unexpired token with the given hash and purpose as used and returns its user,
+	// or returns errAccountTokenInvalid
+	UseAccountToken(ctx context.Context, hash string, purpose string) (primitive.ObjectID, error)
+}
+
+// SessionStore persists the logins of users
+type SessionStore interface {
+	CreateSession(ctx context.Context, session *Session) error
+	// ListSessions returns the sessions of a user that are neither revoked nor expired
+	ListSessions(ctx context.Context, userID string) ([]Session, error)
+	// TouchSession records that an active session was just used, or returns lib.ErrSessionInactive
+	TouchSession(ctx context.Context, sessionID primitive.ObjectID, userID string) error
+	// RefreshSession swaps the refresh ID of an active session from refreshID to newRefreshID, extends it and records the device,
+	// or returns errSessionNotFound if the session is inactive or refreshID is not its current refresh ID
+	RefreshSession(ctx context.Context, sessionID primitive.ObjectID, userID string, refreshID string, newRefreshID string, userAgent string, ip string) (*Session, error)
+	// RevokeSession revokes a session of a user, or returns errSessionNotFound if it is not active
+	RevokeSession(ctx context.Context, sessionID primitive.ObjectID, userID string) error
+	// RevokeSessions revokes every session of a user
+	RevokeSessions(ctx context.Context, userID string) error
+}
+
+// FoodCacheStore persists encoded USDA responses so that they are shared between processes and survive restarts
+type FoodCacheStore interface {
+	// GetCachedFood returns the unexpired value stored under key and when it expires, or errCacheMiss
+	GetCachedFood(ctx context.Context, key string) ([]byte, time.Time, error)
+	// SetCachedFood stores value under key until expiresAt, replacing any earlier value
+	SetCachedFood(ctx context.Context, key string, value []byte, expiresAt time.Time) error
+}
+
+// FoodStore persists foods imported from the FoodData Central downloads so that they can be served without the USDA API
+type FoodStore interface {
+	// SaveFoods inserts the foods, replacing any stored food with the same fdcId
+	SaveFoods(ctx context.Context, foods []fdc.FoodDetailResult) error
+	// GetFoods returns the foods with the given fdcIds in the order given, leaving out unknown IDs
+	GetFoods(ctx context.Context, fdcIDs []int) ([]fdc.FoodDetailResult, error)
+	// EachFood calls fn with every food, stopping at the first error
+	EachFood(ctx context.Context, fn func(food fdc.FoodDetailResult) error) error
+}
+
+// versionMatches reports whether version is one of the expected versions of an If-Match header, nil accepts any version
+func versionMatches(expectedVersions []int64, version int64) bool {
+	if expectedVersions == nil {
+		return true
+	}
+	for _, expected := range expectedVersions {
+		if version == expected {
+			return true
+		}
+	}
+	return false
+}
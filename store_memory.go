@@ -0,0 +1,615 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/refactored-spoon-backend/internal/fdc"
+	"github.com/refactored-spoon-backend/internal/lib"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryDayStore is a DayStore kept in memory, safe for concurrent use
+// records are copied in and out so that callers can never modify stored state
+type MemoryDayStore struct {
+	mu   sync.Mutex
+	days map[string]*DayRecord // keyed by dayKey
+}
+
+// NewMemoryDayStore returns an empty in-memory DayStore
+func NewMemoryDayStore() *MemoryDayStore {
+	return &MemoryDayStore{days: make(map[string]*DayRecord)}
+}
+
+func dayKey(userID string, date string) string {
+	return userID + "/" + date
+}
+
+// GetDay returns the day of a user, or errDayNotFound if the user has not logged anything on that date
+func (s *MemoryDayStore) GetDay(ctx context.Context, userID string, date string) (*DayRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dayRecord, ok := s.days[dayKey(userID, date)]
+	if !ok {
+		return nil, errDayNotFound
+	}
+	return copyDay(dayRecord), nil
+}
+
+// ListDays returns a page of days and the number of days matching the query across all pages
+func (s *MemoryDayStore) ListDays(ctx context.Context, userID string, query DayQuery) ([]DayRecord, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	matching := s.userDays(userID, query.From, query.To)
+	days := make([]DayRecord, 0)
+	for i := (query.Page - 1) * query.PageSize; i < len(matching) && len(days) < query.PageSize; i++ {
+		dayRecord := copyDay(matching[i])
+		switch {
+		case query.Summary:
+			dayRecord.Meals = nil
+		case query.FoodsOnly:
+			*dayRecord = DayRecord{ID: dayRecord.ID, Date: dayRecord.Date, Meals: foodsOnly(dayRecord.Meals)}
+		}
+		days = append(days, *dayRecord)
+	}
+	return days, int64(len(matching)), nil
+}
+
+// DeleteDay removes a day, if expectedVersions is set the day must be at one of those versions or errDayModified is returned
+func (s *MemoryDayStore) DeleteDay(ctx context.Context, userID string, date string, expectedVersions []int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.matchDay(userID, date, expectedVersions); err != nil {
+		return err
+	}
+	delete(s.days, dayKey(userID, date))
+	return nil
+}
+
+// InsertMeal adds a meal at version 1 to a day, creating the day if it doesn't exist yet
+func (s *MemoryDayStore) InsertMeal(ctx context.Context, userID string, date string, meal *Meal) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := dayKey(userID, date)
+	dayRecord, ok := s.days[key]
+	if !ok {
+		dayRecord = &DayRecord{ID: primitive.NewObjectID(), Date: date, UserID: userID}
+		s.days[key] = dayRecord
+	}
+
+	meal.Version = 1
+	dayRecord.Meals = append(dayRecord.Meals, copyMeal(*meal))
+	dayRecord.Nutrition = updateNutrition(dayRecord.Nutrition, meal.Nutrition, 1.0)
+	dayRecord.Version++
+	return nil
+}
+
+// MutateMeal atomically replaces a meal with the result of mutate, or removes it if mutate returns nil,
+// and adjusts the day nutrition by the difference
+func (s *MemoryDayStore) MutateMeal(ctx context.Context, userID string, date string, mealID primitive.ObjectID, expectedVersions []int64, mutate func(original Meal) (*Meal, error)) (*Meal, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dayRecord, ok := s.days[dayKey(userID, date)]
+	if !ok {
+		return nil, errMealNotFound
+	}
+
+	for i, original := range dayRecord.Meals {
+		if original.ID != mealID {
+			continue
+		}
+		if !versionMatches(expectedVersions, original.Version) {
+			return nil, errMealModified
+		}
+
+		meal, err := mutate(copyMeal(original))
+		if err != nil {
+			return nil, err
+		}
+
+		nutrition := updateNutrition(dayRecord.Nutrition, original.Nutrition, -1.0)
+		if meal == nil {
+			dayRecord.Meals = append(dayRecord.Meals[:i:i], dayRecord.Meals[i+1:]...)
+		} else {
+			meal.Version = original.Version + 1
+			dayRecord.Meals[i] = copyMeal(*meal)
+			nutrition = updateNutrition(nutrition, meal.Nutrition, 1.0)
+		}
+		dayRecord.Nutrition = nutrition
+		dayRecord.Version++
+		return meal, nil
+	}
+	return nil, errMealNotFound
+}
+
+// DeleteMeals removes every meal of a day and zeroes its nutrition
+func (s *MemoryDayStore) DeleteMeals(ctx context.Context, userID string, date string, expectedVersions []int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dayRecord, err := s.matchDay(userID, date, expectedVersions)
+	if err != nil {
+		return err
+	}
+	dayRecord.Meals = []Meal{}
+	dayRecord.Nutrition = NutritionSummary{}
+	dayRecord.Version++
+	return nil
+}
+
+// AggregateNutrition computes totals, averages and min/max days of every nutrient between two dates inclusive
+// min and max compare the value first, then the date, like the MongoDB implementation
+func (s *MemoryDayStore) AggregateNutrition(ctx context.Context, userID string, from string, to string) (*NutritionReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	days := s.userDays(userID, from, to)
+	report := &NutritionReport{From: from, To: to, LoggedDays: len(days), Nutrients: make(map[string]NutrientStats)}
+	for name, unit := range nutrientUnits {
+		stats := NutrientStats{UnitName: unit}
+		for i, dayRecord := range days {
+			value := DayValue{Date: dayRecord.Date, Value: dayRecord.Nutrition.fields()[name].Value}
+			stats.Total += value.Value
+			if i == 0 || value.Value < stats.Min.Value || (value.Value == stats.Min.Value && value.Date < stats.Min.Date) {
+				stats.Min = value
+			}
+			if i == 0 || value.Value > stats.Max.Value || (value.Value == stats.Max.Value && value.Date > stats.Max.Date) {
+				stats.Max = value
+			}
+		}
+		if len(days) > 0 {
+			stats.Average = roundTenth(stats.Total / float64(len(days)))
+		}
+		stats.Total = roundTenth(stats.Total)
+		stats.Min.Value = roundTenth(stats.Min.Value)
+		stats.Max.Value = roundTenth(stats.Max.Value)
+		report.Nutrients[name] = stats
+	}
+	return report, nil
+}
+
+// EachDay calls fn with every day of a user, or of all users if userID is empty, stopping at the first error
+func (s *MemoryDayStore) EachDay(ctx context.Context, userID string, fn func(dayRecord DayRecord) error) error {
+	// copy first so that fn can call back into the store
+	s.mu.Lock()
+	days := make([]DayRecord, 0, len(s.days))
+	for _, dayRecord := range s.days {
+		if len(userID) == 0 || dayRecord.UserID == userID {
+			days = append(days, *copyDay(dayRecord))
+		}
+	}
+	s.mu.Unlock()
+
+	for _, dayRecord := range days {
+		if err := fn(dayRecord); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FixDayNutrition overwrites the nutrition of a day as long as it is unchanged since it was read, and bumps its version
+func (s *MemoryDayStore) FixDayNutrition(ctx context.Context, dayRecord DayRecord, nutrition NutritionSummary) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.days[dayKey(dayRecord.UserID, dayRecord.Date)]
+	if !ok || stored.ID != dayRecord.ID || stored.Version != dayRecord.Version {
+		return false, nil
+	}
+	stored.Nutrition = nutrition
+	stored.Version++
+	return true, nil
+}
+
+// userDays returns the days of a user between two dates inclusive sorted by date, the caller must hold the lock
+func (s *MemoryDayStore) userDays(userID string, from string, to string) []*DayRecord {
+	days := make([]*DayRecord, 0)
+	for _, dayRecord := range s.days {
+		if dayRecord.UserID == userID && dayRecord.Date >= from && dayRecord.Date <= to {
+			days = append(days, dayRecord)
+		}
+	}
+	sort.Slice(days, func(i, j int) bool {
+		return days[i].Date < days[j].Date
+	})
+	return days
+}
+
+// matchDay returns a stored day at the expected version, the caller must hold the lock
+func (s *MemoryDayStore) matchDay(userID string, date string, expectedVersions []int64) (*DayRecord, error) {
+	dayRecord, ok := s.days[dayKey(userID, date)]
+	if !ok {
+		return nil, errDayNotFound
+	}
+	if !versionMatches(expectedVersions, dayRecord.Version) {
+		return nil, errDayModified
+	}
+	return dayRecord, nil
+}
+
+func copyDay(dayRecord *DayRecord) *DayRecord {
+	copied := *dayRecord
+	if dayRecord.Meals != nil {
+		copied.Meals = make([]Meal, len(dayRecord.Meals))
+		for i, meal := range dayRecord.Meals {
+			copied.Meals[i] = copyMeal(meal)
+		}
+	}
+	return &copied
+}
+
+// foodsOnly returns meals with nothing but the fdcId and name of their foods, like the FoodsOnly projection of MongoDayStore
+func foodsOnly(meals []Meal) []Meal {
+	trimmed := make([]Meal, len(meals))
+	for i, meal := range meals {
+		trimmed[i].Foods = make([]Food, len(meal.Foods))
+		for j, food := range meal.Foods {
+			trimmed[i].Foods[j] = Food{FdcId: food.FdcId, Name: food.Name}
+		}
+	}
+	return trimmed
+}
+
+func copyMeal(meal Meal) Meal {
+	if meal.Foods != nil {
+		meal.Foods = append([]Food{}, meal.Foods...)
+		for i, food := range meal.Foods {
+			if food.USDANutrition != nil {
+				usdaNutrition := *food.USDANutrition
+				meal.Foods[i].USDANutrition = &usdaNutrition
+			}
+		}
+	}
+	return meal
+}
+
+// MemoryUserStore is a UserStore kept in memory, safe for concurrent use
+type MemoryUserStore struct {
+	mu     sync.Mutex
+	users  map[primitive.ObjectID]*User
+	tokens []*accountToken
+}
+
+// NewMemoryUserStore returns an empty in-memory UserStore
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{users: make(map[primitive.ObjectID]*User)}
+}
+
+// CreateUser stores a new user and sets its ID, or returns errUserExists if the email is taken
+func (s *MemoryUserStore) CreateUser(ctx context.Context, user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.findUserByEmail(user.Email) != nil {
+		return errUserExists
+	}
+
+	user.ID = primitive.NewObjectID()
+	stored := copyUser(user)
+	s.users[user.ID] = stored
+	return nil
+}
+
+// GetUser returns a user by ID, or errUserNotFound
+func (s *MemoryUserStore) GetUser(ctx context.Context, userID primitive.ObjectID) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return nil, errUserNotFound
+	}
+	return copyUser(user), nil
+}
+
+// FindUserByEmail returns a user by email, or errUserNotFound
+func (s *MemoryUserStore) FindUserByEmail(ctx context.Context, email string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user := s.findUserByEmail(email)
+	if user == nil {
+		return nil, errUserNotFound
+	}
+	return copyUser(user), nil
+}
+
+// UpdatePassword replaces the stored password hash of a user
+func (s *MemoryUserStore) UpdatePassword(ctx context.Context, userID primitive.ObjectID, passwordHash string) error {
+	return s.updateUser(userID, func(user *User) {
+		user.Password = passwordHash
+	})
+}
+
+// SetEmailVerified marks the email of a user as verified
+func (s *MemoryUserStore) SetEmailVerified(ctx context.Context, userID primitive.ObjectID) error {
+	return s.updateUser(userID, func(user *User) {
+		user.EmailVerified = true
+	})
+}
+
+// SetProfile replaces the profile of a user, or returns errUserNotFound
+func (s *MemoryUserStore) SetProfile(ctx context.Context, userID primitive.ObjectID, profile Profile) error {
+	return s.updateUser(userID, func(user *User) {
+		user.Profile = profile
+	})
+}
+
+// SetGoals replaces the nutrition goals of a user, or returns errUserNotFound
+func (s *MemoryUserStore) SetGoals(ctx context.Context, userID primitive.ObjectID, goals NutritionGoals) error {
+	return s.updateUser(userID, func(user *User) {
+		user.Goals = copyGoals(goals)
+	})
+}
+
+// CreateAccountToken stores a single-use token
+func (s *MemoryUserStore) CreateAccountToken(ctx context.Context, token accountToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token.ID = primitive.NewObjectID()
+	s.tokens = append(s.tokens, &token)
+	return nil
+}
+
+// UseAccountToken marks the unused, unexpired token with the given hash and purpose as used and returns its user
+func (s *MemoryUserStore) UseAccountToken(ctx context.Context, hash string, purpose string) (primitive.ObjectID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, token := range s.tokens {
+		if token.Hash == hash && token.Purpose == purpose && !token.Used && token.ExpiresAt.After(now) {
+			token.Used = true
+			return token.UserID, nil
+		}
+	}
+	return primitive.NilObjectID, errAccountTokenInvalid
+}
+
+// findUserByEmail returns the stored user with the given email, or nil, the caller must hold the lock
+func (s *MemoryUserStore) findUserByEmail(email string) *User {
+	for _, user := range s.users {
+		if user.Email == email {
+			return user
+		}
+	}
+	return nil
+}
+
+func (s *MemoryUserStore) updateUser(userID primitive.ObjectID, update func(user *User)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return errUserNotFound
+	}
+	update(user)
+	return nil
+}
+
+func copyUser(user *User) *User {
+	copied := *user
+	copied.Goals = copyGoals(user.Goals)
+	return &copied
+}
+
+func copyGoals(goals NutritionGoals) NutritionGoals {
+	if goals == nil {
+		return nil
+	}
+	copied := make(NutritionGoals, len(goals))
+	for name, goal := range goals {
+		copied[name] = goal
+	}
+	return copied
+}
+
+// MemorySessionStore is a SessionStore kept in memory, safe for concurrent use
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[primitive.ObjectID]*Session
+}
+
+// NewMemorySessionStore returns an empty in-memory SessionStore
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: make(map[primitive.ObjectID]*Session)}
+}
+
+// CreateSession stores a new session
+func (s *MemorySessionStore) CreateSession(ctx context.Context, session *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := *session
+	s.sessions[session.ID] = &stored
+	return nil
+}
+
+// ListSessions returns the sessions of a user that are neither revoked nor expired
+func (s *MemorySessionStore) ListSessions(ctx context.Context, userID string) ([]Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	sessions := make([]Session, 0)
+	for _, session := range s.sessions {
+		if session.UserID == userID && sessionActive(session, now) {
+			sessions = append(sessions, *session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+	})
+	return sessions, nil
+}
+
+// TouchSession records that an active session was just used, or returns lib.ErrSessionInactive
+func (s *MemorySessionStore) TouchSession(ctx context.Context, sessionID primitive.ObjectID, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	session, ok := s.sessions[sessionID]
+	if !ok || session.UserID != userID || !sessionActive(session, now) {
+		return lib.ErrSessionInactive
+	}
+	session.LastSeen = now
+	return nil
+}
+
+// RefreshSession swaps the refresh ID of an active session from refreshID to newRefreshID, extends it and records the device
+func (s *MemorySessionStore) RefreshSession(ctx context.Context, sessionID primitive.ObjectID, userID string, refreshID string, newRefreshID string, userAgent string, ip string) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	session, ok := s.sessions[sessionID]
+	if !ok || session.UserID != userID || session.RefreshID != refreshID || !sessionActive(session, now) {
+		return nil, errSessionNotFound
+	}
+
+	session.RefreshID = newRefreshID
+	session.LastSeen = now
+	session.ExpiresAt = now.Add(lib.RefreshTokenTTL)
+	session.UserAgent = userAgent
+	session.IP = ip
+
+	refreshed := *session
+	return &refreshed, nil
+}
+
+// RevokeSession revokes a session of a user, or returns errSessionNotFound if it is not active
+func (s *MemorySessionStore) RevokeSession(ctx context.Context, sessionID primitive.ObjectID, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[sessionID]
+	if !ok || session.UserID != userID || session.Revoked {
+		return errSessionNotFound
+	}
+	session.Revoked = true
+	return nil
+}
+
+// RevokeSessions revokes every session of a user
+func (s *MemorySessionStore) RevokeSessions(ctx context.Context, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, session := range s.sessions {
+		if session.UserID == userID {
+			session.Revoked = true
+		}
+	}
+	return nil
+}
+
+// sessionActive reports whether a session can still be used at the given time
+func sessionActive(session *Session, now time.Time) bool {
+	return !session.Revoked && session.ExpiresAt.After(now)
+}
+
+// MemoryFoodCacheStore is a FoodCacheStore kept in memory, safe for concurrent use
+type MemoryFoodCacheStore struct {
+	mu      sync.Mutex
+	entries map[string]cachedFood
+}
+
+// NewMemoryFoodCacheStore returns an empty in-memory FoodCacheStore
+func NewMemoryFoodCacheStore() *MemoryFoodCacheStore {
+	return &MemoryFoodCacheStore{entries: make(map[string]cachedFood)}
+}
+
+// GetCachedFood returns the unexpired value stored under key and when it expires, or errCacheMiss
+func (s *MemoryFoodCacheStore) GetCachedFood(ctx context.Context, key string) ([]byte, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cached, ok := s.entries[key]
+	if !ok || !cached.ExpiresAt.After(time.Now()) {
+		return nil, time.Time{}, errCacheMiss
+	}
+	return append([]byte(nil), cached.Value...), cached.ExpiresAt, nil
+}
+
+// SetCachedFood stores value under key until expiresAt, replacing any earlier value
+func (s *MemoryFoodCacheStore) SetCachedFood(ctx context.Context, key string, value []byte, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[key] = cachedFood{Key: key, Value: append([]byte(nil), value...), ExpiresAt: expiresAt}
+	return nil
+}
+
+// MemoryFoodStore is a FoodStore kept in memory, safe for concurrent use
+type MemoryFoodStore struct {
+	mu    sync.Mutex
+	foods map[int]fdc.FoodDetailResult
+}
+
+// NewMemoryFoodStore returns an empty in-memory FoodStore
+func NewMemoryFoodStore() *MemoryFoodStore {
+	return &MemoryFoodStore{foods: make(map[int]fdc.FoodDetailResult)}
+}
+
+// SaveFoods inserts the foods, replacing any stored food with the same fdcId
+func (s *MemoryFoodStore) SaveFoods(ctx context.Context, foods []fdc.FoodDetailResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, food := range foods {
+		food.FoodNutrients = append([]fdc.FoodNutrient(nil), food.FoodNutrients...)
+		s.foods[food.FdcId] = food
+	}
+	return nil
+}
+
+// GetFoods returns the foods with the given fdcIds in the order given, leaving out unknown IDs
+func (s *MemoryFoodStore) GetFoods(ctx context.Context, fdcIDs []int) ([]fdc.FoodDetailResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	foods := make([]fdc.FoodDetailResult, 0, len(fdcIDs))
+	for _, fdcID := range fdcIDs {
+		if food, ok := s.foods[fdcID]; ok {
+			food.FoodNutrients = append([]fdc.FoodNutrient(nil), food.FoodNutrients...)
+			foods = append(foods, food)
+		}
+	}
+	return foods, nil
+}
+
+// EachFood calls fn with every food in fdcId order, stopping at the first error
+func (s *MemoryFoodStore) EachFood(ctx context.Context, fn func(food fdc.FoodDetailResult) error) error {
+	s.mu.Lock()
+	fdcIDs := make([]int, 0, len(s.foods))
+	for fdcID := range s.foods {
+		fdcIDs = append(fdcIDs, fdcID)
+	}
+	s.mu.Unlock()
+	sort.Ints(fdcIDs)
+
+	// fn may call back into the store, so foods are looked up one at a time without holding the lock
+	for _, fdcID := range fdcIDs {
+		foods, err := s.GetFoods(ctx, []int{fdcID})
+		if err != nil {
+			return err
+		}
+		for _, food := range foods {
+			if err := fn(food); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,895 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/refactored-spoon-backend/internal/fdc"
+	"github.com/refactored-spoon-backend/internal/lib"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoDayStore is a DayStore backed by the Days collection, one document per user and date
+type MongoDayStore struct {
+	collection *mongo.Collection
+}
+
+// NewMongoDayStore returns a DayStore backed by the given collection
+func NewMongoDayStore(collection *mongo.Collection) *MongoDayStore {
+	return &MongoDayStore{collection: collection}
+}
+
+// GetDay returns the day of a user, or errDayNotFound if the user has not logged anything on that date
+func (s *MongoDayStore) GetDay(ctx context.Context, userID string, date string) (*DayRecord, error) {
+	var dayRecord DayRecord
+	err := s.collection.FindOne(ctx, bson.M{"userId": userID, "date": date}).Decode(&dayRecord)
+	if err == mongo.ErrNoDocuments {
+		return nil, errDayNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &dayRecord, nil
+}
+
+// ListDays returns a page of days and the number of days matching the query across all pages
+func (s *MongoDayStore) ListDays(ctx context.Context, userID string, query DayQuery) ([]DayRecord, int64, error) {
+	filter := bson.M{"userId": userID, "date": bson.M{"$gte": query.From, "$lte": query.To}}
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "date", Value: 1}}).
+		SetSkip(int64((query.Page - 1) * query.PageSize)).
+		SetLimit(int64(query.PageSize))
+	switch {
+	case query.Summary:
+		findOptions.SetProjection(bson.M{"meals": 0})
+	case query.FoodsOnly:
+		findOptions.SetProjection(bson.M{"date": 1, "meals.foods.fdcId": 1, "meals.foods.name": 1})
+	}
+
+	total, err := s.collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cur, err := s.collection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cur.Close(ctx)
+
+	days := make([]DayRecord, 0)
+	for cur.Next(ctx) {
+		var dayRecord DayRecord
+		if err := cur.Decode(&dayRecord); err != nil {
+			return nil, 0, err
+		}
+		days = append(days, dayRecord)
+	}
+	return days, total, cur.Err()
+}
+
+// DeleteDay removes a day, if expectedVersions is set the day must be at one of those versions or errDayModified is returned
+func (s *MongoDayStore) DeleteDay(ctx context.Context, userID string, date string, expectedVersions []int64) error {
+	err := s.collection.FindOneAndDelete(ctx, s.dayFilter(userID, date, expectedVersions)).Err()
+	if err == mongo.ErrNoDocuments {
+		return s.dayNotMatched(ctx, userID, date)
+	}
+	return err
+}
+
+// InsertMeal adds a meal to a day, creating the day if it doesn't exist yet
+// the unique {userId, date} index guarantees concurrent inserts for a new day end up in the same document
+func (s *MongoDayStore) InsertMeal(ctx context.Context, userID string, date string, meal *Meal) error {
+	meal.Version = 1
+	update := bson.M{"$push": bson.M{"meals": meal}}
+	addNutritionUpdate(update, meal.Nutrition, meal.Nutrition, 1.0)
+
+	filter := bson.M{"userId": userID, "date": date}
+	_, err := s.collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if isDuplicateKeyError(err) {
+		// another request created the day between our match and insert, it exists now so a plain update succeeds
+		_, err = s.collection.UpdateOne(ctx, filter, update)
+	}
+	return err
+}
+
+// MutateMeal atomically replaces a meal of a day with the result of mutate, or removes it if mutate returns nil,
+// and adjusts the day nutrition by the difference
+// the update only applies if the meal is unchanged since it was read, otherwise mutate is retried with a fresh read
+// if expectedVersions is set the meal must be at one of those versions, which is how If-Match is honored
+func (s *MongoDayStore) MutateMeal(ctx context.Context, userID string, date string, mealID primitive.ObjectID, expectedVersions []int64, mutate func(original Meal) (*Meal, error)) (*Meal, error) {
+	for attempt := 0; attempt < maxMealUpdateAttempts; attempt++ {
+		original, err := findDayMeal(ctx, s, userID, date, mealID)
+		if err != nil {
+			return nil, err
+		}
+		if !versionMatches(expectedVersions, original.Version) {
+			return nil, errMealModified
+		}
+
+		meal, err := mutate(*original)
+		if err != nil {
+			return nil, err
+		}
+
+		var update bson.M
+		if meal == nil {
+			update = bson.M{"$pull": bson.M{"meals": bson.M{"_id": mealID}}}
+			addNutritionUpdate(update, NutritionSummary{}, original.Nutrition, -1.0)
+		} else {
+			meal.Version = original.Version + 1
+			update = bson.M{"$set": bson.M{"meals.$": meal}}
+			addNutritionUpdate(update, meal.Nutrition, updateNutrition(meal.Nutrition, original.Nutrition, -1.0), 1.0)
+		}
+
+		// the meal is only replaced if nobody changed it since it was read
+		filter := bson.M{"userId": userID, "date": date, "meals": bson.M{"$elemMatch": bson.M{"_id": mealID, "version": versionFilter(original.Version)}}}
+		res, err := s.collection.UpdateOne(ctx, filter, update)
+		if err != nil {
+			return nil, err
+		}
+		if res.MatchedCount > 0 {
+			return meal, nil
+		}
+	}
+	return nil, errMealConflict
+}
+
+// DeleteMeals removes every meal of a day and zeroes its nutrition
+// if expectedVersions is set the day must be at one of those versions or errDayModified is returned
+func (s *MongoDayStore) DeleteMeals(ctx context.Context, userID string, date string, expectedVersions []int64) error {
+	res, err := s.collection.UpdateOne(ctx, s.dayFilter(userID, date, expectedVersions), bson.M{
+		"$set": bson.M{"meals": []Meal{}, "nutrition": NutritionSummary{}},
+		"$inc": bson.M{"version": 1},
+	})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return s.dayNotMatched(ctx, userID, date)
+	}
+	return nil
+}
+
+// AggregateNutrition computes totals, averages and min/max days of every nutrient between two dates inclusive
+// the work is done by an aggregation pipeline so that only a single summary document is returned by MongoDB
+func (s *MongoDayStore) AggregateNutrition(ctx context.Context, userID string, from string, to string) (*NutritionReport, error) {
+	// flatten each day to { date, <nutrient>: value } with missing values counting as zero
+	project := bson.M{"_id": 0, "date": 1}
+	group := bson.M{"_id": nil, "loggedDays": bson.M{"$sum": 1}}
+	for name := range nutrientUnits {
+		project[name] = bson.M{"$ifNull": bson.A{"$nutrition." + name + ".value", 0}}
+
+		// $min and $max on documents compare the value first, then the date
+		group[name+"_total"] = bson.M{"$sum": "$" + name}
+		group[name+"_avg"] = bson.M{"$avg": "$" + name}
+		group[name+"_min"] = bson.M{"$min": bson.D{{Key: "value", Value: "$" + name}, {Key: "date", Value: "$date"}}}
+		group[name+"_max"] = bson.M{"$max": bson.D{{Key: "value", Value: "$" + name}, {Key: "date", Value: "$date"}}}
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"userId": userID, "date": bson.M{"$gte": from, "$lte": to}}}},
+		{{Key: "$project", Value: project}},
+		{{Key: "$group", Value: group}},
+	}
+
+	cur, err := s.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	report := &NutritionReport{From: from, To: to, Nutrients: make(map[string]NutrientStats)}
+	if !cur.Next(ctx) {
+		// no logged days in the period
+		for name, unit := range nutrientUnits {
+			report.Nutrients[name] = NutrientStats{UnitName: unit}
+		}
+		return report, cur.Err()
+	}
+
+	var result bson.M
+	if err := cur.Decode(&result); err != nil {
+		return nil, err
+	}
+
+	report.LoggedDays = int(toFloat(result["loggedDays"]))
+	for name, unit := range nutrientUnits {
+		min, err := toDayValue(result[name+"_min"])
+		if err != nil {
+			return nil, err
+		}
+		max, err := toDayValue(result[name+"_max"])
+		if err != nil {
+			return nil, err
+		}
+
+		report.Nutrients[name] = NutrientStats{
+			UnitName: unit,
+			Total:    roundTenth(toFloat(result[name+"_total"])),
+			Average:  roundTenth(toFloat(result[name+"_avg"])),
+			Min:      min,
+			Max:      max,
+		}
+	}
+	return report, nil
+}
+
+// EachDay calls fn with every day of a user, or of all users if userID is empty, stopping at the first error
+func (s *MongoDayStore) EachDay(ctx context.Context, userID string, fn func(dayRecord DayRecord) error) error {
+	filter := bson.M{}
+	if len(userID) > 0 {
+		filter["userId"] = userID
+	}
+
+	cur, err := s.collection.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var dayRecord DayRecord
+		if err := cur.Decode(&dayRecord); err != nil {
+			return err
+		}
+		if err := fn(dayRecord); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+// FixDayNutrition overwrites the nutrition of a day as long as it is unchanged since it was read,
+// bumping its version so that clients holding an older ETag cannot overwrite the repaired totals
+func (s *MongoDayStore) FixDayNutrition(ctx context.Context, dayRecord DayRecord, nutrition NutritionSummary) (bool, error) {
+	res, err := s.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": dayRecord.ID, "version": versionFilter(dayRecord.Version)},
+		bson.M{"$set": bson.M{"nutrition": nutrition}, "$inc": bson.M{"version": 1}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+// EnsureIndexes creates the indexes used to look up and range-scan the days of a user
+// the {userId, date} index is unique so that concurrent upserts can never create two documents for the same day,
+// days written twice before it existed are merged first since the index could not be built otherwise
+func (s *MongoDayStore) EnsureIndexes(ctx context.Context) error {
+	merged, err := s.MergeDuplicateDays(ctx)
+	if err != nil {
+		return err
+	}
+	if merged > 0 {
+		log.Printf("merged %d days stored more than once\n", merged)
+	}
+
+	_, err = s.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "userId", Value: 1}, {Key: "date", Value: 1}},
+		Options: options.Index().SetName(dayIndexName).SetUnique(true),
+	})
+	return err
+}
+
+// MergeDuplicateDays merges every group of documents of a user for the same date into one, reporting how many groups it merged
+func (s *MongoDayStore) MergeDuplicateDays(ctx context.Context) (int, error) {
+	cur, err := s.collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"userId": "$userId", "date": "$date"},
+			"ids":   bson.M{"$push": "$_id"},
+			"count": bson.M{"$sum": 1},
+		}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return 0, err
+	}
+	var duplicates []struct {
+		Day struct {
+			Date string `bson:"date"`
+		} `bson:"_id"`
+		IDs []primitive.ObjectID `bson:"ids"`
+	}
+	if err := cur.All(ctx, &duplicates); err != nil {
+		return 0, err
+	}
+
+	for i, duplicate := range duplicates {
+		if err := s.mergeDays(ctx, duplicate.IDs, duplicate.Day.Date); err != nil {
+			return i, err
+		}
+	}
+	return len(duplicates), nil
+}
+
+// mergeDays merges the days with the given IDs into one at the given date, with the meals of all of them,
+// its nutrition recomputed from those and a version above all of theirs so that no ETag read before matches
+// the day kept is the oldest one already at that date so that it never collides with the others in the unique index,
+// and meals are merged by ID so that merging again after being interrupted does not duplicate them
+func (s *MongoDayStore) mergeDays(ctx context.Context, ids []primitive.ObjectID, date string) error {
+	cur, err := s.collection.Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	var days []DayRecord
+	if err := cur.All(ctx, &days); err != nil {
+		return err
+	}
+	if len(days) < 2 {
+		return nil
+	}
+
+	keep := 0
+	for i, dayRecord := range days {
+		if dayRecord.Date == date {
+			keep = i
+			break
+		}
+	}
+	merged := days[keep]
+	merged.Date = date
+	merged.Meals = make([]Meal, 0)
+	seen := make(map[primitive.ObjectID]bool)
+	duplicateIDs := make([]primitive.ObjectID, 0, len(days)-1)
+	for i, dayRecord := range days {
+		for _, meal := range dayRecord.Meals {
+			if !seen[meal.ID] {
+				seen[meal.ID] = true
+				merged.Meals = append(merged.Meals, meal)
+			}
+		}
+		if dayRecord.Version > merged.Version {
+			merged.Version = dayRecord.Version
+		}
+		if i != keep {
+			duplicateIDs = append(duplicateIDs, dayRecord.ID)
+		}
+	}
+	merged.Nutrition = sumMealNutrition(merged.Meals)
+	merged.Version++
+
+	// the kept day is written before the others are removed so that no meal is ever lost
+	if _, err := s.collection.ReplaceOne(ctx, bson.M{"_id": merged.ID}, merged); err != nil {
+		return err
+	}
+	_, err = s.collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": duplicateIDs}})
+	return err
+}
+
+// MigrateDates rewrites days stored with a legacy ddmmyy date to the sortable YYYY-MM-DD format
+// a legacy day is merged into the day the user already has at the new date, which the unique index allows only one of
+func (s *MongoDayStore) MigrateDates(ctx context.Context) error {
+	cur, err := s.collection.Find(ctx, bson.M{"date": bson.M{"$regex": "^[0-9]{6}$"}}, options.Find().SetProjection(bson.M{"date": 1, "userId": 1}))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var dayRecord DayRecord
+		if err := cur.Decode(&dayRecord); err != nil {
+			return err
+		}
+
+		date, err := normalizeDate(dayRecord.Date)
+		if err != nil {
+			log.Println("skipping day " + dayRecord.ID.Hex() + " with unparseable date: " + dayRecord.Date)
+			continue
+		}
+
+		_, err = s.collection.UpdateOne(ctx, bson.M{"_id": dayRecord.ID}, bson.M{"$set": bson.M{"date": date}})
+		if isDuplicateKeyError(err) {
+			var existing DayRecord
+			err = s.collection.FindOne(ctx, bson.M{"userId": dayRecord.UserID, "date": date}, options.FindOne().SetProjection(bson.M{"_id": 1})).Decode(&existing)
+			if err == nil {
+				err = s.mergeDays(ctx, []primitive.ObjectID{existing.ID, dayRecord.ID}, date)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+func (s *MongoDayStore) dayFilter(userID string, date string, expectedVersions []int64) bson.M {
+	filter := bson.M{"userId": userID, "date": date}
+	if expectedVersions != nil {
+		filter["version"] = versionsFilter(expectedVersions)
+	}
+	return filter
+}
+
+// dayNotMatched tells apart a day that doesn't exist from one that changed since the client read it
+// after an update or delete of the day matched no document
+func (s *MongoDayStore) dayNotMatched(ctx context.Context, userID string, date string) error {
+	count, err := s.collection.CountDocuments(ctx, bson.M{"userId": userID, "date": date})
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errDayModified
+	}
+	return errDayNotFound
+}
+
+// versionFilter matches documents at the given version, documents from before versioning count as version 0
+func versionFilter(version int64) interface{} {
+	if version == 0 {
+		return bson.M{"$in": bson.A{0, nil}}
+	}
+	return version
+}
+
+// versionsFilter matches documents at any of the given versions, like versionFilter does for one
+func versionsFilter(versions []int64) interface{} {
+	if len(versions) == 1 {
+		return versionFilter(versions[0])
+	}
+	in := bson.A{}
+	for _, version := range versions {
+		in = append(in, version)
+		if version == 0 {
+			in = append(in, nil)
+		}
+	}
+	return bson.M{"$in": in}
+}
+
+// addNutritionUpdate adds operators to an update that increment the day nutrition by sign * delta and the day version,
+// and carry over the nutrient and unit names of named, leaving out operators that would be empty
+func addNutritionUpdate(update bson.M, named NutritionSummary, delta NutritionSummary, sign float64) {
+	increment := bson.M{}
+	for name, nutrient := range delta.fields() {
+		if nutrient.Value != 0 {
+			increment["nutrition."+name+".value"] = sign * nutrient.Value
+		}
+	}
+	// every change to a day bumps its version
+	increment["version"] = 1
+	update["$inc"] = increment
+
+	set, _ := update["$set"].(bson.M)
+	if set == nil {
+		set = bson.M{}
+	}
+	for name, nutrient := range named.fields() {
+		if len(nutrient.NutrientName) > 0 {
+			set["nutrition."+name+".nutrientName"] = nutrient.NutrientName
+		}
+		if len(nutrient.UnitName) > 0 {
+			set["nutrition."+name+".unitName"] = nutrient.UnitName
+		}
+	}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+}
+
+func isDuplicateKeyError(err error) bool {
+	writeException, ok := err.(mongo.WriteException)
+	if !ok {
+		return false
+	}
+	for _, writeError := range writeException.WriteErrors {
+		if writeError.Code == 11000 {
+			return true
+		}
+	}
+	return false
+}
+
+func toDayValue(value interface{}) (DayValue, error) {
+	var dayValue DayValue
+	var doc bson.M
+	switch v := value.(type) {
+	case bson.M:
+		doc = v
+	case bson.D:
+		doc = v.Map()
+	default:
+		return dayValue, errors.New("unexpected aggregation result")
+	}
+	dayValue.Date, _ = doc["date"].(string)
+	dayValue.Value = roundTenth(toFloat(doc["value"]))
+	return dayValue, nil
+}
+
+// toFloat converts the numeric types MongoDB may return from an aggregation to a float64
+func toFloat(value interface{}) float64 {
+	switch v := value.(type) {
+	case float64:
+		return v
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	}
+	return 0
+}
+
+// MongoUserStore is a UserStore backed by the Users and AccountTokens collections
+type MongoUserStore struct {
+	users  *mongo.Collection
+	tokens *mongo.Collection
+}
+
+// NewMongoUserStore returns a UserStore backed by the given collections
+func NewMongoUserStore(users *mongo.Collection, tokens *mongo.Collection) *MongoUserStore {
+	return &MongoUserStore{users: users, tokens: tokens}
+}
+
+// EnsureIndexes creates the unique email index that keeps two concurrent signups from creating the same user
+func (s *MongoUserStore) EnsureIndexes(ctx context.Context) error {
+	_, err := s.users.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "email", Value: 1}},
+		Options: options.Index().SetName("email_1").SetUnique(true),
+	})
+	return err
+}
+
+// CreateUser stores a new user and sets its ID, or returns errUserExists if the email is taken
+func (s *MongoUserStore) CreateUser(ctx context.Context, user *User) error {
+	// the lookup only saves an insert for taken emails, the unique email index settles concurrent signups
+	_, err := s.FindUserByEmail(ctx, user.Email)
+	if err == nil {
+		return errUserExists
+	}
+	if err != errUserNotFound {
+		return err
+	}
+
+	res, err := s.users.InsertOne(ctx, bson.M{"email": user.Email, "password": user.Password})
+	if isDuplicateKeyError(err) {
+		return errUserExists
+	}
+	if err != nil {
+		return err
+	}
+	user.ID = res.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// GetUser returns a user by ID, or errUserNotFound
+func (s *MongoUserStore) GetUser(ctx context.Context, userID primitive.ObjectID) (*User, error) {
+	return s.findUser(ctx, bson.M{"_id": userID})
+}
+
+// FindUserByEmail returns a user by email, or errUserNotFound
+func (s *MongoUserStore) FindUserByEmail(ctx context.Context, email string) (*User, error) {
+	return s.findUser(ctx, bson.M{"email": email})
+}
+
+// UpdatePassword replaces the stored password hash of a user
+func (s *MongoUserStore) UpdatePassword(ctx context.Context, userID primitive.ObjectID, passwordHash string) error {
+	return s.setUser(ctx, userID, bson.M{"password": passwordHash})
+}
+
+// SetEmailVerified marks the email of a user as verified
+func (s *MongoUserStore) SetEmailVerified(ctx context.Context, userID primitive.ObjectID) error {
+	return s.setUser(ctx, userID, bson.M{"emailVerified": true})
+}
+
+// SetProfile replaces the profile of a user, or returns errUserNotFound
+func (s *MongoUserStore) SetProfile(ctx context.Context, userID primitive.ObjectID, profile Profile) error {
+	return s.setUser(ctx, userID, bson.M{"profile": profile})
+}
+
+// SetGoals replaces the nutrition goals of a user, or returns errUserNotFound
+func (s *MongoUserStore) SetGoals(ctx context.Context, userID primitive.ObjectID, goals NutritionGoals) error {
+	return s.setUser(ctx, userID, bson.M{"goals": goals})
+}
+
+// CreateAccountToken stores a single-use token
+func (s *MongoUserStore) CreateAccountToken(ctx context.Context, token accountToken) error {
+	_, err := s.tokens.InsertOne(ctx, token)
+	return err
+}
+
+// UseAccountToken marks the unused, unexpired token with the given hash and purpose as used and returns its user
+func (s *MongoUserStore) UseAccountToken(ctx context.Context, hash string, purpose string) (primitive.ObjectID, error) {
+	var found accountToken
+	err := s.tokens.FindOneAndUpdate(
+		ctx,
+		bson.M{"hash": hash, "purpose": purpose, "used": false, "expiresAt": bson.M{"$gt": time.Now()}},
+		bson.M{"$set": bson.M{"used": true}},
+	).Decode(&found)
+	if err == mongo.ErrNoDocuments {
+		return primitive.NilObjectID, errAccountTokenInvalid
+	}
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	return found.UserID, nil
+}
+
+func (s *MongoUserStore) findUser(ctx context.Context, filter bson.M) (*User, error) {
+	var user User
+	err := s.users.FindOne(ctx, filter).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil, errUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *MongoUserStore) setUser(ctx context.Context, userID primitive.ObjectID, set bson.M) error {
+	res, err := s.users.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$set": set})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+// MongoSessionStore is a SessionStore backed by the Sessions collection
+type MongoSessionStore struct {
+	collection *mongo.Collection
+}
+
+// NewMongoSessionStore returns a SessionStore backed by the given collection
+func NewMongoSessionStore(collection *mongo.Collection) *MongoSessionStore {
+	return &MongoSessionStore{collection: collection}
+}
+
+// CreateSession stores a new session
+func (s *MongoSessionStore) CreateSession(ctx context.Context, session *Session) error {
+	_, err := s.collection.InsertOne(ctx, session)
+	return err
+}
+
+// ListSessions returns the sessions of a user that are neither revoked nor expired
+func (s *MongoSessionStore) ListSessions(ctx context.Context, userID string) ([]Session, error) {
+	cur, err := s.collection.Find(ctx, bson.M{"userId": userID, "revoked": false, "expiresAt": bson.M{"$gt": time.Now()}})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	sessions := make([]Session, 0)
+	for cur.Next(ctx) {
+		var session Session
+		if err := cur.Decode(&session); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, cur.Err()
+}
+
+// TouchSession records that an active session was just used, or returns lib.ErrSessionInactive
+func (s *MongoSessionStore) TouchSession(ctx context.Context, sessionID primitive.ObjectID, userID string) error {
+	now := time.Now()
+	res, err := s.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": sessionID, "userId": userID, "revoked": false, "expiresAt": bson.M{"$gt": now}},
+		bson.M{"$set": bson.M{"lastSeen": now}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return lib.ErrSessionInactive
+	}
+	return nil
+}
+
+// RefreshSession swaps the refresh ID of an active session from refreshID to newRefreshID, extends it and records the device
+func (s *MongoSessionStore) RefreshSession(ctx context.Context, sessionID primitive.ObjectID, userID string, refreshID string, newRefreshID string, userAgent string, ip string) (*Session, error) {
+	now := time.Now()
+	var session Session
+	err := s.collection.FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": sessionID, "userId": userID, "refreshId": refreshID, "revoked": false, "expiresAt": bson.M{"$gt": now}},
+		bson.M{"$set": bson.M{
+			"refreshId": newRefreshID,
+			"lastSeen":  now,
+			"expiresAt": now.Add(lib.RefreshTokenTTL),
+			"userAgent": userAgent,
+			"ip":        ip,
+		}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		return nil, errSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// RevokeSession revokes a session of a user, or returns errSessionNotFound if it is not active
+func (s *MongoSessionStore) RevokeSession(ctx context.Context, sessionID primitive.ObjectID, userID string) error {
+	res, err := s.collection.UpdateOne(ctx, bson.M{"_id": sessionID, "userId": userID, "revoked": false}, bson.M{"$set": bson.M{"revoked": true}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errSessionNotFound
+	}
+	return nil
+}
+
+// RevokeSessions revokes every session of a user
+func (s *MongoSessionStore) RevokeSessions(ctx context.Context, userID string) error {
+	_, err := s.collection.UpdateMany(ctx, bson.M{"userId": userID, "revoked": false}, bson.M{"$set": bson.M{"revoked": true}})
+	return err
+}
+
+// MongoFoodCacheStore is a FoodCacheStore backed by a MongoDB collection
+// expired entries are removed by a TTL index, which MongoDB only checks once a minute, so reads also filter on expiry
+type MongoFoodCacheStore struct {
+	collection *mongo.Collection
+}
+
+// cachedFood is a document in the FoodCache collection
+type cachedFood struct {
+	Key       string    `bson:"_id"`
+	Value     []byte    `bson:"value"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// NewMongoFoodCacheStore returns a FoodCacheStore backed by the given collection
+func NewMongoFoodCacheStore(collection *mongo.Collection) *MongoFoodCacheStore {
+	return &MongoFoodCacheStore{collection: collection}
+}
+
+// GetCachedFood returns the unexpired value stored under key and when it expires, or errCacheMiss
+func (s *MongoFoodCacheStore) GetCachedFood(ctx context.Context, key string) ([]byte, time.Time, error) {
+	var cached cachedFood
+	err := s.collection.FindOne(ctx, bson.M{"_id": key, "expiresAt": bson.M{"$gt": time.Now()}}).Decode(&cached)
+	if err == mongo.ErrNoDocuments {
+		return nil, time.Time{}, errCacheMiss
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return cached.Value, cached.ExpiresAt, nil
+}
+
+// SetCachedFood stores value under key until expiresAt, replacing any earlier value
+func (s *MongoFoodCacheStore) SetCachedFood(ctx context.Context, key string, value []byte, expiresAt time.Time) error {
+	_, err := s.collection.ReplaceOne(ctx, bson.M{"_id": key}, cachedFood{Key: key, Value: value, ExpiresAt: expiresAt}, options.Replace().SetUpsert(true))
+	return err
+}
+
+// EnsureIndexes creates the TTL index that deletes cache entries once they expire
+func (s *MongoFoodCacheStore) EnsureIndexes(ctx context.Context) error {
+	_, err := s.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+		Options: options.Index().SetName("expiresAt_ttl").SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+// MongoFoodStore is a FoodStore backed by the Foods collection, one document per FoodData Central food
+type MongoFoodStore struct {
+	collection *mongo.Collection
+}
+
+// foodDocument is a document in the Foods collection
+type foodDocument struct {
+	FdcId           int                `bson:"_id"`
+	DataType        string             `bson:"dataType"`
+	FoodClass       string             `bson:"foodClass,omitempty"`
+	Description     string             `bson:"description"`
+	BrandOwner      string             `bson:"brandOwner,omitempty"`
+	GtinUpc         string             `bson:"gtinUpc,omitempty"`
+	Ingredients     string             `bson:"ingredients,omitempty"`
+	ServingSize     float64            `bson:"servingSize,omitempty"`
+	ServingSizeUnit string             `bson:"servingSizeUnit,omitempty"`
+	PublicationDate string             `bson:"publicationDate,omitempty"`
+	FoodNutrients   []fdc.FoodNutrient `bson:"foodNutrients"`
+}
+
+func newFoodDocument(food fdc.FoodDetailResult) foodDocument {
+	return foodDocument{
+		FdcId:           food.FdcId,
+		DataType:        food.DataType,
+		FoodClass:       food.FoodClass,
+		Description:     food.Description,
+		BrandOwner:      food.BrandOwner,
+		GtinUpc:         food.GtinUpc,
+		Ingredients:     food.Ingredients,
+		ServingSize:     food.ServingSize,
+		ServingSizeUnit: food.ServingSizeUnit,
+		PublicationDate: food.PublicationDate,
+		FoodNutrients:   food.FoodNutrients,
+	}
+}
+
+func (d foodDocument) food() fdc.FoodDetailResult {
+	return fdc.FoodDetailResult{
+		FdcId:           d.FdcId,
+		DataType:        d.DataType,
+		FoodClass:       d.FoodClass,
+		Description:     d.Description,
+		BrandOwner:      d.BrandOwner,
+		GtinUpc:         d.GtinUpc,
+		Ingredients:     d.Ingredients,
+		ServingSize:     d.ServingSize,
+		ServingSizeUnit: d.ServingSizeUnit,
+		PublicationDate: d.PublicationDate,
+		FoodNutrients:   d.FoodNutrients,
+	}
+}
+
+// NewMongoFoodStore returns a FoodStore backed by the given collection
+func NewMongoFoodStore(collection *mongo.Collection) *MongoFoodStore {
+	return &MongoFoodStore{collection: collection}
+}
+
+// SaveFoods inserts the foods, replacing any stored food with the same fdcId
+func (s *MongoFoodStore) SaveFoods(ctx context.Context, foods []fdc.FoodDetailResult) error {
+	if len(foods) == 0 {
+		return nil
+	}
+
+	models := make([]mongo.WriteModel, len(foods))
+	for i, food := range foods {
+		models[i] = mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": food.FdcId}).SetReplacement(newFoodDocument(food)).SetUpsert(true)
+	}
+	_, err := s.collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// GetFoods returns the foods with the given fdcIds in the order given, leaving out unknown IDs
+func (s *MongoFoodStore) GetFoods(ctx context.Context, fdcIDs []int) ([]fdc.FoodDetailResult, error) {
+	cur, err := s.collection.Find(ctx, bson.M{"_id": bson.M{"$in": fdcIDs}})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	found := make(map[int]fdc.FoodDetailResult, len(fdcIDs))
+	for cur.Next(ctx) {
+		var doc foodDocument
+		if err := cur.Decode(&doc); err != nil {
+			return nil, err
+		}
+		found[doc.FdcId] = doc.food()
+	}
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+
+	foods := make([]fdc.FoodDetailResult, 0, len(found))
+	for _, fdcID := range fdcIDs {
+		if food, ok := found[fdcID]; ok {
+			foods = append(foods, food)
+		}
+	}
+	return foods, nil
+}
+
+// EachFood calls fn with every food, stopping at the first error
+func (s *MongoFoodStore) EachFood(ctx context.Context, fn func(food fdc.FoodDetailResult) error) error {
+	cur, err := s.collection.Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var doc foodDocument
+		if err := cur.Decode(&doc); err != nil {
+			return err
+		}
+		if err := fn(doc.food()); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
@@ -1,247 +1,181 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"log"
+	"math"
 	"net/http"
-	"os"
 	"strconv"
-	"strings"
-)
-
-const (
-	usdaFoodDataCentralEndpoint = "https://api.nal.usda.gov/fdc/v1/"
-)
+	"time"
 
-var (
-	apiKey = os.Getenv("USDA_API_KEY")
+	"github.com/refactored-spoon-backend/internal/fdc"
+	"github.com/refactored-spoon-backend/internal/lib"
 )
 
-// FoodSearchCriteria is the body for the USDA POST /search request
-type FoodSearchCriteria struct {
-	GeneralSearchInput string `json:"generalSearchInput,omitempty"`
-	PageNumber         int    `json:"pageNumber,omitempty"`
-	PageSize           int    `json:"pageSize,omitempty"`
-	RequireAllWords    bool   `json:"requireAllWords,omitempty"`
-}
-
-// UsdaFood is the food result in the USDA POST /search response
-type UsdaFood struct {
-	FdcId         int                    `json:"fdcId,omitempty"`
-	Description   string                 `json:"description,omitempty"`
-	BrandOwner    string                 `json:"brandOwner,omitempty"`
-	Ingredients   string                 `json:"ingredients,omitempty"`
-	FoodNutrients []AbridgedFoodNutrient `json:"foodNutrients,omitempty"`
-}
-
-// AbridgedFoodNutrient is the nutrient result in the USDA POST /search response
-// note that this contains much less information than FoodNutrient, which is what the USDA POST /foods response contains
-type AbridgedFoodNutrient struct {
-	NutrientId   int     `json:"nutrientId,omitempty"`
-	NutrientName string  `json:"nutrientName,omitempty"`
-	UnitName     string  `json:"unitName,omitempty"`
-	Value        float64 `json:"value,omitempty"`
-}
+// usdaRequestTimeout bounds a USDA lookup including retries so that the response beats the server write timeout
+const usdaRequestTimeout = 7 * time.Second
 
-// FoodSearchResult is the body of the USDA POST /search response
-type FoodSearchResult struct {
-	FoodSearchCriteria FoodSearchCriteria `json:"foodSearchCriteria,omitempty"`
-	CurrentPage        int                `json:"currentPage,omitempty"`
-	TotalPages         int                `json:"totalPages,omitempty"`
-	Foods              []UsdaFood         `json:"foods,omitempty"`
+// FoodSource looks up foods in FoodData Central, in a cache of it or in a local copy of its downloads
+type FoodSource interface {
+	Search(ctx context.Context, criteria fdc.FoodSearchCriteria) (*fdc.FoodSearchResult, error)
+	Food(ctx context.Context, fdcID int) (*fdc.FoodDetailResult, error)
+	Foods(ctx context.Context, fdcIDs []int) ([]fdc.FoodDetailResult, error)
 }
 
-// Food Details (/foods) (currently unused)
-
-// FoodDetailRequest is the body for the USDA POST /foods request
+// FoodDetailRequest is the body for POST /food/detail
 type FoodDetailRequest struct {
-	FdcId int `json:"fdcId,omitempty"`
+	FdcId int `json:"fdcId,omitempty" validate:"required,gt=0"`
 }
 
-// FoodsDetailRequest is the body for the USDA bulk POST /foods request
+// FoodsDetailRequest is the body for POST /foods/detail
 type FoodsDetailRequest struct {
-	FdcIds []int `json:"fdcIds,omitempty"`
-}
-
-// FoodDetailRequest is the body for the USDA POST /foods response
-type FoodDetailResult struct {
-	FdcId           int            `json:"fdcId,omitempty"`
-	FoodClass       string         `json:"foodClass,omitempty"`
-	Description     string         `json:"description,omitempty"`
-	Ingredients     string         `json:"ingredients,omitempty"`
-	ServingSize     float64        `json:"servingSize,omitempty"`
-	ServingSizeUnit string         `json:"servingSizeUnit,omitempty"`
-	FoodNutrients   []FoodNutrient `json:"foodNutrients,omitempty"`
+	FdcIds []int `json:"fdcIds,omitempty" validate:"required,max=20,dive,gt=0"` // USDA accepts at most 20 IDs per request
 }
 
-// FoodNutrient is the nutrient result in the USDA POST /foods response
-// note that this contains more information than the AbridgedFoodNutrient returned in the POST /search response
-type FoodNutrient struct {
-	Type     string       `json:"type,omitempty"`
-	Id       int          `json:"id,omitempty"`
-	Nutrient USDANutrient `json:"nutrient,omitempty"`
-	Amount   float64      `json:"amount,omitempty"`
-}
-
-// USDANutrient is the USDA-specific nutrient result in the USDA POST /foods response
-type USDANutrient struct {
-	Id       int    `json:"id,omitempty"`
-	Number   string `json:"number,omitempty"`
-	Name     string `json:"name,omitempty"`
-	Rank     int    `json:"rank,omitempty"`
-	UnitName string `json:"unitName,omitempty"`
-}
-
-// End of Food Details
-
 // SearchFood queries the USDA database by search keyword string and retrieves a list of matching foods with basic information
-func SearchFood(w http.ResponseWriter, r *http.Request) {
-	client := &http.Client{}
-
+func (s *server) SearchFood(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
-	var foodSearchCriteria FoodSearchCriteria
+	var foodSearchCriteria fdc.FoodSearchCriteria
 	err := decoder.Decode(&foodSearchCriteria)
 	if err != nil {
-		log.Println(err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("unable to decode food search request:\n" + err.Error()))
+		lib.WriteDecodeError(w, r, "unable to decode food search request", err)
 		return
 	}
 
-	foodSearchCriteriaJSON, err := json.Marshal(foodSearchCriteria)
+	err = lib.Validate(foodSearchCriteria)
 	if err != nil {
-		log.Println(err.Error())
+		lib.WriteValidationError(w, r, err)
 		return
 	}
-
-	req, err := http.NewRequest(http.MethodPost, usdaFoodDataCentralEndpoint+"search?api_key="+apiKey, bytes.NewBuffer(foodSearchCriteriaJSON))
-	if err != nil {
-		log.Println(err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("unable to create POST request to search USDA food data central db:\n" + err.Error()))
-		return
+	if len(foodSearchCriteria.SortBy) > 0 && len(foodSearchCriteria.SortOrder) == 0 {
+		foodSearchCriteria.SortOrder = "asc"
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	res, err := client.Do(req)
+	ctx, cacheStatus := withFoodCacheStatus(r)
+	ctx, cancel := context.WithTimeout(ctx, usdaRequestTimeout)
+	defer cancel()
+	searchResults, err := s.foods.Search(ctx, foodSearchCriteria)
 	if err != nil {
-		log.Println(err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("unable to send POST request to search USDA food data central db:\n" + err.Error()))
-		return
-	}
-	defer res.Body.Close()
-
-	decoder = json.NewDecoder(res.Body)
-	var searchResults FoodSearchResult
-	err = decoder.Decode(&searchResults)
-	if err != nil {
-		log.Println(err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("unable to decode food search results: " + err.Error()))
+		writeUSDAError(w, r, "unable to search USDA food data central db", err)
 		return
 	}
 
+	cacheStatus.setHeader(w)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(searchResults)
 }
 
 // FoodDetail queries the USDA database and returns the details of a food given the FoodData Central ID of the food
 // note that this function is currently not being used
-func FoodDetail(w http.ResponseWriter, r *http.Request) {
-	client := &http.Client{}
-
+func (s *server) FoodDetail(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	var queryStr FoodDetailRequest
 	err := decoder.Decode(&queryStr)
 	if err != nil {
-		log.Println(err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("unable to decode food detail request:\n" + err.Error()))
-		return
-	}
-
-	req, err := http.NewRequest(http.MethodGet, usdaFoodDataCentralEndpoint+strconv.Itoa(queryStr.FdcId)+"?api_key="+apiKey, nil)
-	if err != nil {
-		log.Println(err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("unable to create GET request to detail USDA food data central db:\n" + err.Error()))
+		lib.WriteDecodeError(w, r, "unable to decode food detail request", err)
 		return
 	}
 
-	res, err := client.Do(req)
+	err = lib.Validate(queryStr)
 	if err != nil {
-		log.Println(err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("unable to send GET request to detail USDA food data central db:\n" + err.Error()))
+		lib.WriteValidationError(w, r, err)
 		return
 	}
-	defer res.Body.Close()
 
-	decoder = json.NewDecoder(res.Body)
-	var searchResults FoodDetailResult
-	err = decoder.Decode(&searchResults)
+	ctx, cacheStatus := withFoodCacheStatus(r)
+	ctx, cancel := context.WithTimeout(ctx, usdaRequestTimeout)
+	defer cancel()
+	food, err := s.foods.Food(ctx, queryStr.FdcId)
 	if err != nil {
-		log.Println(err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("unable to decode food detail results: " + err.Error()))
+		writeUSDAError(w, r, "unable to get food detail from USDA food data central db", err)
 		return
 	}
 
+	cacheStatus.setHeader(w)
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(searchResults)
+	json.NewEncoder(w).Encode(food)
 }
 
 // FoodsDetail queries the USDA database and returns the details of a list of foods given a list of FoodData Central IDs of the foods
 // note that this function is currently not being used
-func FoodsDetail(w http.ResponseWriter, r *http.Request) {
-	client := &http.Client{}
-
+func (s *server) FoodsDetail(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	var queryStr FoodsDetailRequest
 	err := decoder.Decode(&queryStr)
 	if err != nil {
-		log.Println(err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("unable to decode foods detail request:\n" + err.Error()))
+		lib.WriteDecodeError(w, r, "unable to decode foods detail request", err)
 		return
 	}
 
-	fdcIds := ""
-
-	for _, fdcId := range queryStr.FdcIds {
-		fdcIds += strconv.Itoa(fdcId) + ","
+	err = lib.Validate(queryStr)
+	if err != nil {
+		lib.WriteValidationError(w, r, err)
+		return
 	}
-	fdcIds = strings.TrimSuffix(fdcIds, ",")
 
-	req, err := http.NewRequest(http.MethodGet, usdaFoodDataCentralEndpoint+"foods?api_key="+apiKey+"&fdcIds="+fdcIds, nil)
+	ctx, cacheStatus := withFoodCacheStatus(r)
+	ctx, cancel := context.WithTimeout(ctx, usdaRequestTimeout)
+	defer cancel()
+	foods, err := s.foods.Foods(ctx, queryStr.FdcIds)
 	if err != nil {
-		log.Println(err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("unable to create GET request to detail USDA food data central db:\n" + err.Error()))
+		writeUSDAError(w, r, "unable to get foods detail from USDA food data central db", err)
 		return
 	}
 
-	res, err := client.Do(req)
-	if err != nil {
-		log.Println(err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("unable to send GET request to detail USDA food data central db:\n" + err.Error()))
+	cacheStatus.setHeader(w)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(foods)
+}
+
+// writeUSDAError responds 404 for foods USDA does not know, 503 while USDA is down or rate limiting us
+// and 502 for every other USDA failure, the underlying error is only logged since it may contain USDA internals
+func writeUSDAError(w http.ResponseWriter, r *http.Request, message string, err error) {
+	if fdc.IsNotFound(err) || err == errUnknownFdcID {
+		lib.WriteError(w, r, http.StatusNotFound, lib.CodeNotFound, "could not find food in USDA food data central db", nil)
 		return
 	}
-	defer res.Body.Close()
 
-	decoder = json.NewDecoder(res.Body)
-	var searchResults []FoodDetailResult
-	err = decoder.Decode(&searchResults)
-	if err != nil {
-		log.Println(err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("unable to decode foods detail results: " + err.Error()))
+	log.Printf("[%s] %s: %s\n", lib.RequestIDFromContext(r.Context()), message, err.Error())
+
+	if err == errFoodIndexLoading {
+		lib.WriteError(w, r, http.StatusServiceUnavailable, lib.CodeUnavailable, "food search is starting up, try again later", nil)
+		return
+	}
+
+	if retryAfter, unavailable := fdc.Unavailable(err); unavailable {
+		if retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		}
+		lib.WriteError(w, r, http.StatusServiceUnavailable, lib.CodeUnavailable, "USDA food data central is unavailable, try again later", nil)
+		return
+	}
+	lib.WriteError(w, r, http.StatusBadGateway, lib.CodeBadGateway, message, nil)
+}
+
+// FoodCacheStatsHandler handles /admin/cache/foods GET requests, reporting how USDA lookups were served
+func (s *server) FoodCacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	cache, ok := s.foods.(*CachedFoodSource)
+	if !ok {
+		lib.WriteError(w, r, http.StatusNotFound, lib.CodeNotFound, "food cache is disabled", nil)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(searchResults)
+	json.NewEncoder(w).Encode(cache.Stats())
+}
+
+// ReindexFoodsHandler handles /admin/foods/reindex POST requests, rebuilding the search index of the local food source
+// in the background so that it picks up foods imported since the server started
+func (s *server) ReindexFoodsHandler(w http.ResponseWriter, r *http.Request) {
+	local, ok := s.foods.(*LocalFoodSource)
+	if !ok {
+		lib.WriteError(w, r, http.StatusNotFound, lib.CodeNotFound, "local food source is disabled", nil)
+		return
+	}
+	if !local.StartReindex() {
+		lib.WriteError(w, r, http.StatusConflict, lib.CodeConflict, "food search index is already being rebuilt", nil)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
 }
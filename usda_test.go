@@ -0,0 +1,544 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/refactored-spoon-backend/internal/fdc"
+	"github.com/refactored-spoon-backend/internal/lib"
+)
+
+// usdaTest is a request to one of the USDA routes and the response of the fake FoodData Central server behind it
+type usdaTest struct {
+	name    string
+	path    string
+	body    interface{}
+	usda    http.HandlerFunc // nil if the request should never reach USDA
+	want    int
+	wantErr string
+	check   func(t *testing.T, w *httptest.ResponseRecorder)
+}
+
+// newTestUSDAClient returns a FoodData Central client for a fake server that retries without waiting long
+func newTestUSDAClient(baseURL string) *fdc.Client {
+	client := fdc.NewClient(baseURL, testUSDAKey, 5*time.Second)
+	client.RetryWait = time.Millisecond
+	client.MaxRetryWait = 10 * time.Millisecond
+	return client
+}
+
+func runUSDATests(t *testing.T, tests []usdaTest) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t)
+
+			usda := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.usda == nil {
+					t.Errorf("unexpected USDA request %s %s", r.Method, r.URL)
+					w.WriteHeader(http.StatusTeapot)
+					return
+				}
+				tt.usda(w, r)
+			}))
+			defer usda.Close()
+			s.foods = newTestUSDAClient(usda.URL + "/fdc/v1/")
+
+			w := serve(t, s.Handler(), http.MethodPost, tt.path, "", tt.body, nil)
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+
+			if len(tt.wantErr) > 0 {
+				var apiErr lib.APIError
+				decodeResponse(t, w, &apiErr)
+				if apiErr.Code != tt.wantErr {
+					t.Fatalf("got error code %q, want %q: %s", apiErr.Code, tt.wantErr, apiErr.Message)
+				}
+			}
+			if tt.check != nil {
+				tt.check(t, w)
+			}
+		})
+	}
+}
+
+// respondUSDA returns a fake USDA handler that checks the request path and responds with the given status and body
+func respondUSDA(t *testing.T, method string, path string, status int, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method || r.URL.Path != path {
+			t.Errorf("got USDA request %s %s, want %s %s", r.Method, r.URL.Path, method, path)
+		}
+		if key := r.Header.Get("X-Api-Key"); key != testUSDAKey {
+			t.Errorf("got API key %q, want %q", key, testUSDAKey)
+		}
+		if len(r.URL.Query().Get("api_key")) > 0 {
+			t.Errorf("API key leaked into the URL %s", r.URL)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}
+}
+
+const (
+	testUSDAKey = "test-key"
+
+	usdaSearchResponse = `{"foodSearchCriteria":{"generalSearchInput":"banana","pageNumber":1},"currentPage":1,"totalPages":3,` +
+		`"foods":[{"fdcId":1105314,"description":"Banana, raw","foodNutrients":[{"nutrientId":1008,"nutrientName":"Energy","unitName":"KCAL","value":89}]}]}`
+	usdaFoodResponse = `{"fdcId":1105314,"description":"Banana, raw","foodClass":"FinalFood",` +
+		`"foodNutrients":[{"type":"FoodNutrient","id":1,"nutrient":{"id":1008,"number":"208","name":"Energy","unitName":"kcal"},"amount":89}]}`
+	usdaBrandedSearchResponse = `{"totalHits":61,"currentPage":1,"totalPages":2,"pageList":[1,2],"foods":[{"fdcId":2344720,"dataType":"Branded",` +
+		`"description":"Banana chips","brandOwner":"Crunchy Co","gtinUpc":"012345678905","servingSize":30,"servingSizeUnit":"g","publishedDate":"2022-04-01"}]}`
+	usdaServerError = `{"error":"internal server error"}`
+)
+
+func TestSearchFood(t *testing.T) {
+	runUSDATests(t, []usdaTest{
+		{
+			name: "search",
+			path: "/food/search",
+			body: fdc.FoodSearchCriteria{GeneralSearchInput: "banana", PageNumber: 1, PageSize: 10},
+			usda: func(w http.ResponseWriter, r *http.Request) {
+				var criteria fdc.FoodSearchCriteria
+				if err := json.NewDecoder(r.Body).Decode(&criteria); err != nil {
+					t.Errorf("unable to decode USDA search request: %v", err)
+				}
+				if criteria.GeneralSearchInput != "banana" || criteria.PageSize != 10 {
+					t.Errorf("got USDA search criteria %+v", criteria)
+				}
+				respondUSDA(t, http.MethodPost, "/fdc/v1/foods/search", http.StatusOK, usdaSearchResponse)(w, r)
+			},
+			want: http.StatusOK,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				var res fdc.FoodSearchResult
+				decodeResponse(t, w, &res)
+				if res.TotalPages != 3 || len(res.Foods) != 1 || res.Foods[0].FdcId != 1105314 {
+					t.Fatalf("got search result %+v", res)
+				}
+				if res.Foods[0].FoodNutrients[0].Value != 89 {
+					t.Errorf("got nutrients %+v", res.Foods[0].FoodNutrients)
+				}
+			},
+		},
+		{
+			name: "search with filters and sorting",
+			path: "/food/search",
+			body: fdc.FoodSearchCriteria{GeneralSearchInput: "chips", DataType: []string{fdc.DataTypeBranded, fdc.DataTypeSRLegacy}, BrandOwner: "Crunchy Co", SortBy: fdc.SortByPublished},
+			usda: func(w http.ResponseWriter, r *http.Request) {
+				var criteria fdc.FoodSearchCriteria
+				if err := json.NewDecoder(r.Body).Decode(&criteria); err != nil {
+					t.Errorf("unable to decode USDA search request: %v", err)
+				}
+				want := fdc.FoodSearchCriteria{GeneralSearchInput: "chips",
+					DataType: []string{fdc.DataTypeBranded, fdc.DataTypeSRLegacy}, BrandOwner: "Crunchy Co", SortBy: fdc.SortByPublished, SortOrder: "asc"}
+				if !reflect.DeepEqual(criteria, want) {
+					t.Errorf("got USDA search criteria %+v, want %+v", criteria, want)
+				}
+				respondUSDA(t, http.MethodPost, "/fdc/v1/foods/search", http.StatusOK, usdaBrandedSearchResponse)(w, r)
+			},
+			want: http.StatusOK,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				var res fdc.FoodSearchResult
+				decodeResponse(t, w, &res)
+				if res.TotalHits != 61 || res.CurrentPage != 1 || res.TotalPages != 2 || !reflect.DeepEqual(res.PageList, []int{1, 2}) {
+					t.Fatalf("got pagination of search result %+v", res)
+				}
+				food := res.Foods[0]
+				if food.DataType != fdc.DataTypeBranded || food.GtinUpc != "012345678905" || food.ServingSize != 30 || food.ServingSizeUnit != "g" || food.PublishedDate != "2022-04-01" {
+					t.Errorf("got food %+v", food)
+				}
+			},
+		},
+		{
+			name:    "invalid sort field",
+			path:    "/food/search",
+			body:    fdc.FoodSearchCriteria{GeneralSearchInput: "chips", SortBy: "calories"},
+			want:    http.StatusUnprocessableEntity,
+			wantErr: lib.CodeValidationFailed,
+		},
+		{
+			name:    "USDA server error",
+			path:    "/food/search",
+			body:    fdc.FoodSearchCriteria{GeneralSearchInput: "banana"},
+			usda:    respondUSDA(t, http.MethodPost, "/fdc/v1/foods/search", http.StatusInternalServerError, usdaServerError),
+			want:    http.StatusBadGateway,
+			wantErr: lib.CodeBadGateway,
+		},
+		{
+			name:    "USDA unavailable",
+			path:    "/food/search",
+			body:    fdc.FoodSearchCriteria{GeneralSearchInput: "banana"},
+			usda:    respondUSDA(t, http.MethodPost, "/fdc/v1/foods/search", http.StatusServiceUnavailable, "upstream connect error"),
+			want:    http.StatusServiceUnavailable,
+			wantErr: lib.CodeUnavailable,
+		},
+		{
+			name:    "malformed USDA response",
+			path:    "/food/search",
+			body:    fdc.FoodSearchCriteria{GeneralSearchInput: "banana"},
+			usda:    respondUSDA(t, http.MethodPost, "/fdc/v1/foods/search", http.StatusOK, `{"foods": [`),
+			want:    http.StatusBadGateway,
+			wantErr: lib.CodeBadGateway,
+		},
+		{
+			name:    "missing search input",
+			path:    "/food/search",
+			body:    fdc.FoodSearchCriteria{PageSize: 10},
+			want:    http.StatusUnprocessableEntity,
+			wantErr: lib.CodeValidationFailed,
+		},
+		{
+			name:    "page size too large",
+			path:    "/food/search",
+			body:    fdc.FoodSearchCriteria{GeneralSearchInput: "banana", PageSize: 201},
+			want:    http.StatusUnprocessableEntity,
+			wantErr: lib.CodeValidationFailed,
+		},
+		{
+			name:    "malformed request",
+			path:    "/food/search",
+			body:    `{"generalSearchInput": 1}`,
+			want:    http.StatusBadRequest,
+			wantErr: lib.CodeInvalidJSON,
+		},
+	})
+}
+
+func TestFoodDetail(t *testing.T) {
+	runUSDATests(t, []usdaTest{
+		{
+			name: "detail",
+			path: "/food/detail",
+			body: FoodDetailRequest{FdcId: 1105314},
+			usda: respondUSDA(t, http.MethodGet, "/fdc/v1/food/1105314", http.StatusOK, usdaFoodResponse),
+			want: http.StatusOK,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				var res fdc.FoodDetailResult
+				decodeResponse(t, w, &res)
+				if res.FdcId != 1105314 || len(res.FoodNutrients) != 1 || res.FoodNutrients[0].Nutrient.Name != "Energy" {
+					t.Fatalf("got food detail %+v", res)
+				}
+			},
+		},
+		{
+			name:    "unknown food",
+			path:    "/food/detail",
+			body:    FoodDetailRequest{FdcId: 42},
+			usda:    respondUSDA(t, http.MethodGet, "/fdc/v1/food/42", http.StatusNotFound, ""),
+			want:    http.StatusNotFound,
+			wantErr: lib.CodeNotFound,
+		},
+		{
+			name:    "USDA server error",
+			path:    "/food/detail",
+			body:    FoodDetailRequest{FdcId: 1105314},
+			usda:    respondUSDA(t, http.MethodGet, "/fdc/v1/food/1105314", http.StatusBadGateway, usdaServerError),
+			want:    http.StatusBadGateway,
+			wantErr: lib.CodeBadGateway,
+		},
+		{
+			name:    "malformed USDA response",
+			path:    "/food/detail",
+			body:    FoodDetailRequest{FdcId: 1105314},
+			usda:    respondUSDA(t, http.MethodGet, "/fdc/v1/food/1105314", http.StatusOK, `<html>rate limited</html>`),
+			want:    http.StatusBadGateway,
+			wantErr: lib.CodeBadGateway,
+		},
+		{
+			name:    "missing fdcId",
+			path:    "/food/detail",
+			body:    FoodDetailRequest{},
+			want:    http.StatusUnprocessableEntity,
+			wantErr: lib.CodeValidationFailed,
+		},
+	})
+}
+
+func TestFoodsDetail(t *testing.T) {
+	runUSDATests(t, []usdaTest{
+		{
+			name: "detail",
+			path: "/foods/detail",
+			body: FoodsDetailRequest{FdcIds: []int{1105314, 1102653}},
+			usda: func(w http.ResponseWriter, r *http.Request) {
+				if fdcIds := r.URL.Query().Get("fdcIds"); fdcIds != "1105314,1102653" {
+					t.Errorf("got fdcIds %q", fdcIds)
+				}
+				respondUSDA(t, http.MethodGet, "/fdc/v1/foods", http.StatusOK, "["+usdaFoodResponse+","+usdaFoodResponse+"]")(w, r)
+			},
+			want: http.StatusOK,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				var res []fdc.FoodDetailResult
+				decodeResponse(t, w, &res)
+				if len(res) != 2 {
+					t.Fatalf("got %d foods, want 2", len(res))
+				}
+			},
+		},
+		{
+			name:    "USDA server error",
+			path:    "/foods/detail",
+			body:    FoodsDetailRequest{FdcIds: []int{1105314}},
+			usda:    respondUSDA(t, http.MethodGet, "/fdc/v1/foods", http.StatusInternalServerError, usdaServerError),
+			want:    http.StatusBadGateway,
+			wantErr: lib.CodeBadGateway,
+		},
+		{
+			name:    "malformed USDA response",
+			path:    "/foods/detail",
+			body:    FoodsDetailRequest{FdcIds: []int{1105314}},
+			usda:    respondUSDA(t, http.MethodGet, "/fdc/v1/foods", http.StatusOK, usdaFoodResponse),
+			want:    http.StatusBadGateway,
+			wantErr: lib.CodeBadGateway,
+		},
+		{
+			name:    "too many fdcIds",
+			path:    "/foods/detail",
+			body:    FoodsDetailRequest{FdcIds: make([]int, 21)},
+			want:    http.StatusUnprocessableEntity,
+			wantErr: lib.CodeValidationFailed,
+		},
+		{
+			name:    "non-positive fdcId",
+			path:    "/foods/detail",
+			body:    FoodsDetailRequest{FdcIds: []int{1105314, 0}},
+			want:    http.StatusUnprocessableEntity,
+			wantErr: lib.CodeValidationFailed,
+		},
+	})
+}
+
+func TestUSDAUnreachable(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	// a server that is closed straight away refuses connections
+	usda := httptest.NewServer(http.NotFoundHandler())
+	usda.Close()
+	s.foods = newTestUSDAClient(usda.URL)
+
+	w := serve(t, s.Handler(), http.MethodPost, "/food/search", "", fdc.FoodSearchCriteria{GeneralSearchInput: "banana"}, nil)
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusBadGateway, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), usda.URL) {
+		t.Errorf("error response leaks the USDA URL: %s", w.Body.String())
+	}
+}
+
+// scriptedResponse is one response of a fake USDA server that answers requests in order
+type scriptedResponse struct {
+	status     int
+	body       string
+	retryAfter string
+}
+
+func TestUSDARetries(t *testing.T) {
+	tests := []struct {
+		name           string
+		path           string
+		body           interface{}
+		responses      []scriptedResponse // the last one repeats
+		want           int
+		wantErr        string
+		wantRequests   int
+		wantRetryAfter string
+	}{
+		{
+			name:         "recovers after unavailable",
+			path:         "/food/search",
+			body:         fdc.FoodSearchCriteria{GeneralSearchInput: "banana"},
+			responses:    []scriptedResponse{{status: http.StatusServiceUnavailable}, {status: http.StatusTooManyRequests, retryAfter: "0"}, {status: http.StatusOK, body: usdaSearchResponse}},
+			want:         http.StatusOK,
+			wantRequests: 3,
+		},
+		{
+			name:         "gives up after retries",
+			path:         "/food/search",
+			body:         fdc.FoodSearchCriteria{GeneralSearchInput: "banana"},
+			responses:    []scriptedResponse{{status: http.StatusInternalServerError, body: usdaServerError}},
+			want:         http.StatusBadGateway,
+			wantErr:      lib.CodeBadGateway,
+			wantRequests: 1 + fdc.DefaultRetries,
+		},
+		{
+			name:           "does not wait for a long Retry-After",
+			path:           "/food/detail",
+			body:           FoodDetailRequest{FdcId: 1105314},
+			responses:      []scriptedResponse{{status: http.StatusTooManyRequests, retryAfter: "120"}},
+			want:           http.StatusServiceUnavailable,
+			wantErr:        lib.CodeUnavailable,
+			wantRequests:   1,
+			wantRetryAfter: "120",
+		},
+		{
+			name:         "does not retry unknown foods",
+			path:         "/food/detail",
+			body:         FoodDetailRequest{FdcId: 42},
+			responses:    []scriptedResponse{{status: http.StatusNotFound}},
+			want:         http.StatusNotFound,
+			wantErr:      lib.CodeNotFound,
+			wantRequests: 1,
+		},
+		{
+			name:         "does not retry malformed responses",
+			path:         "/foods/detail",
+			body:         FoodsDetailRequest{FdcIds: []int{1105314}},
+			responses:    []scriptedResponse{{status: http.StatusOK, body: `[{"fdcId":`}},
+			want:         http.StatusBadGateway,
+			wantErr:      lib.CodeBadGateway,
+			wantRequests: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			requests := 0
+			usda := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				res := tt.responses[len(tt.responses)-1]
+				if requests < len(tt.responses) {
+					res = tt.responses[requests]
+				}
+				requests++
+				mu.Unlock()
+
+				if len(res.retryAfter) > 0 {
+					w.Header().Set("Retry-After", res.retryAfter)
+				}
+				w.WriteHeader(res.status)
+				w.Write([]byte(res.body))
+			}))
+			defer usda.Close()
+
+			s, _ := newTestServer(t)
+			s.foods = newTestUSDAClient(usda.URL)
+
+			w := serve(t, s.Handler(), http.MethodPost, tt.path, "", tt.body, nil)
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+			if len(tt.wantErr) > 0 {
+				var apiErr lib.APIError
+				decodeResponse(t, w, &apiErr)
+				if apiErr.Code != tt.wantErr {
+					t.Errorf("got error code %q, want %q", apiErr.Code, tt.wantErr)
+				}
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("got Retry-After %q, want %q", got, tt.wantRetryAfter)
+			}
+			if requests != tt.wantRequests {
+				t.Errorf("got %d USDA requests, want %d", requests, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestUSDACircuitBreaker(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	failing := true
+	usda := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if failing {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(usdaFoodResponse))
+	}))
+	defer usda.Close()
+
+	const cooldown = 100 * time.Millisecond
+	client := newTestUSDAClient(usda.URL)
+	client.Retries = 0
+	client.Breaker = fdc.NewBreaker(2, cooldown)
+
+	s, _ := newTestServer(t)
+	s.foods = client
+	h := s.Handler()
+
+	detail := func(want int, wantRequests int) {
+		t.Helper()
+		w := serve(t, h, http.MethodPost, "/food/detail", "", FoodDetailRequest{FdcId: 1105314}, nil)
+		if w.Code != want {
+			t.Fatalf("got status %d, want %d: %s", w.Code, want, w.Body.String())
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if requests != wantRequests {
+			t.Fatalf("got %d USDA requests, want %d", requests, wantRequests)
+		}
+	}
+
+	detail(http.StatusBadGateway, 1)
+	detail(http.StatusBadGateway, 2)
+
+	// the circuit is open, so USDA is not asked and clients are told when to come back
+	w := serve(t, h, http.MethodPost, "/food/detail", "", FoodDetailRequest{FdcId: 1105314}, nil)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("got status %d with Retry-After %q, want %d with 1", w.Code, w.Header().Get("Retry-After"), http.StatusServiceUnavailable)
+	}
+	detail(http.StatusServiceUnavailable, 2)
+
+	// after the cooldown a failing trial request reopens the circuit
+	time.Sleep(cooldown)
+	detail(http.StatusBadGateway, 3)
+	detail(http.StatusServiceUnavailable, 3)
+
+	// and a successful one closes it
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	time.Sleep(cooldown)
+	detail(http.StatusOK, 4)
+	detail(http.StatusOK, 5)
+}
+
+func TestUSDACircuitBreakerCountsRequestsNotAttempts(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	usda := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer usda.Close()
+
+	client := newTestUSDAClient(usda.URL)
+	client.Breaker = fdc.NewBreaker(2, time.Minute)
+
+	s, _ := newTestServer(t)
+	s.foods = client
+	h := s.Handler()
+
+	// a request that fails every retry is a single failure, so the circuit stays closed
+	w := serve(t, h, http.MethodPost, "/food/detail", "", FoodDetailRequest{FdcId: 1105314}, nil)
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusBadGateway, w.Body.String())
+	}
+	if requests != 1+fdc.DefaultRetries {
+		t.Fatalf("got %d USDA requests, want %d", requests, 1+fdc.DefaultRetries)
+	}
+	if client.Breaker.Open() {
+		t.Fatal("circuit opened after one failed request")
+	}
+
+	// and the second one opens it
+	w = serve(t, h, http.MethodPost, "/food/detail", "", FoodDetailRequest{FdcId: 1105314}, nil)
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusBadGateway, w.Body.String())
+	}
+	if !client.Breaker.Open() {
+		t.Fatal("circuit still closed after two failed requests")
+	}
+}
@@ -2,91 +2,194 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/refactored-spoon-backend/internal/lib"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
 )
 
+const (
+	// passwordHashCost is the bcrypt work factor used for new and upgraded password hashes
+	passwordHashCost = 12
+)
+
+// loginResponse is the body of a successful login, containing the tokens used to authenticate later requests
+type loginResponse struct {
+	UserID       string `json:"userId"`
+	SessionID    string `json:"sessionId"`
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+	ExpiresIn    int    `json:"expiresIn"` // seconds until the access token expires
+}
+
+// userRequest is the body for POST /login
+// the email is not checked to be one since accounts created before signup required an email have a free-form username
 type userRequest struct {
-	ID       primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
-	Email    string             `json:"email,omitempty" bson:"email,omitempty"`
-	Password string             `json:"password,omitempty" bson:"password,omitempty"`
+	Email    string `json:"email,omitempty" validate:"required"`
+	Password string `json:"password,omitempty" validate:"required"`
 }
 
-// Signup handles the sign up logic for a new user
-func Signup(w http.ResponseWriter, r *http.Request) {
-	collection := lib.GetCollection("Users")
+// User is an account in the Users collection
+type User struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty"`
+	Email         string             `bson:"email,omitempty"`
+	Password      string             `bson:"password,omitempty"` // bcrypt hash, or plaintext for accounts that have not logged in since hashing was introduced
+	EmailVerified bool               `bson:"emailVerified,omitempty"`
+	Profile       Profile            `bson:"profile,omitempty"`
+	Goals         NutritionGoals     `bson:"goals,omitempty"`
+}
+
+// signupRequest is the body for POST /signup
+// bcrypt ignores everything past 72 bytes of a password
+type signupRequest struct {
+	Email    string `json:"email,omitempty" validate:"required,email,max=254"`
+	Password string `json:"password,omitempty" validate:"required,min=8,maxbytes=72"`
+}
 
+// Signup handles the sign up logic for a new user
+func (s *server) Signup(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
-	var userReq userRequest
+	var userReq signupRequest
 	err := decoder.Decode(&userReq)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("could not decode user signup request:\n" + err.Error()))
+		lib.WriteDecodeError(w, r, "could not decode user signup request", err)
+		return
+	}
+
+	err = lib.Validate(userReq)
+	if err != nil {
+		lib.WriteValidationError(w, r, err)
 		return
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	// See if username already exists
-	var findRes userRequest
-	err = collection.FindOne(ctx, bson.M{"email": userReq.Email}).Decode(&findRes)
-
-	if err == nil {
-		w.WriteHeader(http.StatusConflict)
-		w.Write([]byte("user with this username already exists!"))
+	passwordHash, err := hashPassword(userReq.Password)
+	if err != nil {
+		lib.WriteInternalError(w, r, "unable to hash password", err)
 		return
 	}
 
-	if err != nil && err != mongo.ErrNoDocuments {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("error looking up user with this username:\n" + err.Error()))
+	user := User{Email: userReq.Email, Password: passwordHash}
+	err = s.users.CreateUser(ctx, &user)
+	if err == errUserExists {
+		lib.WriteError(w, r, http.StatusConflict, lib.CodeConflict, err.Error(), nil)
 		return
 	}
-
-	res, err := collection.InsertOne(ctx, bson.M{"email": userReq.Email, "password": userReq.Password})
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("unable to insert into user collection:\n" + err.Error()))
+		lib.WriteInternalError(w, r, "unable to insert into user collection", err)
 		return
 	}
 
+	s.sendVerificationEmail(ctx, user.ID, user.Email)
+
 	w.WriteHeader(http.StatusCreated)
-	w.Write([]byte(res.InsertedID.(primitive.ObjectID).Hex()))
+	w.Write([]byte(user.ID.Hex()))
 }
 
 // Login handles the login logic for a user
-func Login(w http.ResponseWriter, r *http.Request) {
-	collection := lib.GetCollection("Users")
-
+func (s *server) Login(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	var userReq userRequest
 	err := decoder.Decode(&userReq)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("could not decode user login request:\n" + err.Error()))
+		lib.WriteDecodeError(w, r, "could not decode user login request", err)
+		return
+	}
+
+	err = lib.Validate(userReq)
+	if err != nil {
+		lib.WriteValidationError(w, r, err)
 		return
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	res := collection.FindOne(ctx, bson.M{"email": userReq.Email, "password": userReq.Password})
+	findRes, err := s.users.FindUserByEmail(ctx, userReq.Email)
+	if err == errUserNotFound {
+		lib.WriteError(w, r, http.StatusUnauthorized, lib.CodeUnauthorized, "incorrect email or password", nil)
+		return
+	}
+	if err != nil {
+		lib.WriteInternalError(w, r, "error looking up user with this email", err)
+		return
+	}
 
-	var findRes userRequest
-	err = res.Decode(&findRes)
+	match, needsRehash := checkPassword(findRes.Password, userReq.Password)
+	if !match {
+		lib.WriteError(w, r, http.StatusUnauthorized, lib.CodeUnauthorized, "incorrect email or password", nil)
+		return
+	}
+
+	// transparently upgrade legacy plaintext passwords and outdated hashes now that we know the password
+	if needsRehash {
+		upgradePassword(ctx, s.users, findRes.ID, userReq.Password)
+	}
+
+	session, err := createSession(ctx, s.sessions, r, findRes.ID.Hex())
+	if err != nil {
+		lib.WriteInternalError(w, r, "unable to create session", err)
+		return
+	}
+
+	loginRes, err := issueSessionTokens(session)
+	if err != nil {
+		lib.WriteInternalError(w, r, "unable to issue tokens", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(loginRes)
+}
+
+// hashPassword returns a salted bcrypt hash of the given password
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordHashCost)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("could not find user with this login."))
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// checkPassword reports whether password matches the stored value, and whether the stored value should be rehashed
+// stored values that are not bcrypt hashes are legacy plaintext passwords from before hashing was introduced
+func checkPassword(stored string, password string) (match bool, needsRehash bool) {
+	if !isPasswordHash(stored) {
+		match = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+		return match, match
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) != nil {
+		return false, false
+	}
+
+	cost, err := bcrypt.Cost([]byte(stored))
+	return true, err != nil || cost < passwordHashCost
+}
+
+func isPasswordHash(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$")
+}
+
+// upgradePassword replaces the stored password of a user with a fresh hash
+// failures are only logged since the user has already been authenticated
+func upgradePassword(ctx context.Context, users UserStore, userID primitive.ObjectID, password string) {
+	passwordHash, err := hashPassword(password)
+	if err != nil {
+		log.Println("unable to hash password for user " + userID.Hex() + ": " + err.Error())
 		return
 	}
 
-	w.WriteHeader(http.StatusFound)
-	w.Write([]byte(findRes.ID.Hex()))
+	err = users.UpdatePassword(ctx, userID, passwordHash)
+	if err != nil {
+		log.Println("unable to upgrade password for user " + userID.Hex() + ": " + err.Error())
+	}
 }